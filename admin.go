@@ -0,0 +1,234 @@
+package goproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler serves a JSON API for operating a running proxy. Mount it on NonProxyHandler,
+// which receives requests addressed to the proxy itself, or on a separate listener:
+//
+//	admin := goproxy.NewAdminHandler(proxy, token)
+//	admin.Tracer = tracer
+//	proxy.NonProxyHandler = admin
+//
+// Every request must carry the token, either as "Authorization: Bearer <token>" or in an
+// X-Admin-Token header. The endpoints are:
+//
+//	GET  /tunnels                 Lists open tunnels
+//	POST /tunnels/kill?session=N  Closes a tunnel
+//	POST /trace                   Starts a trace: {"host": "example.com", "options": ["unmodified"], "seconds": 120}
+//	POST /certs/flush             Removes a cached certificate: {"host": "example.com"}
+//	GET  /logs?signature=S        Returns log entries buffered for a client signature (see GetLogEntries)
+//	POST /har/flush               Writes captured HAR entries to HARFile
+//	GET  /metrics                 Serves the proxy's Metrics
+//	GET  /fingerprints/unknown    Lists clients missing from the proxy's FingerprintDB, if learning
+type AdminHandler struct {
+	Proxy *ProxyHttpServer
+
+	// Requests without this token are refused. If empty, every request is refused.
+	Token string
+
+	// Used by /trace. If nil, tracing isn't available.
+	Tracer *RequestTracer
+
+	// File that /har/flush writes to. If empty, HAR flushing isn't available.
+	HARFile string
+}
+
+// NewAdminHandler returns an AdminHandler for proxy which requires the given token.
+func NewAdminHandler(proxy *ProxyHttpServer, token string) *AdminHandler {
+	return &AdminHandler{Proxy: proxy, Token: token}
+}
+
+type adminTunnel struct {
+	Session         int64     `json:"session"`
+	Host            string    `json:"host"`
+	SNI             string    `json:"sni,omitempty"`
+	Client          string    `json:"client"`
+	CipherSignature string    `json:"signature,omitempty"`
+	Start           time.Time `json:"start"`
+	LastActivity    time.Time `json:"last_activity"`
+	AgeSeconds      float64   `json:"age_seconds"`
+	BytesUp         uint64    `json:"bytes_up"`
+	BytesDown       uint64    `json:"bytes_down"`
+}
+
+type adminTraceRequest struct {
+	Host    string   `json:"host"`
+	Options []string `json:"options"`
+	Seconds int      `json:"seconds"`
+}
+
+type adminCertRequest struct {
+	Host string `json:"host"`
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		adminError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/tunnels":
+		if a.method(w, r, "GET") {
+			a.tunnels(w)
+		}
+	case "/tunnels/kill":
+		if a.method(w, r, "POST") {
+			a.killTunnel(w, r)
+		}
+	case "/trace":
+		if a.method(w, r, "POST") {
+			a.trace(w, r)
+		}
+	case "/certs/flush":
+		if a.method(w, r, "POST") {
+			a.flushCert(w, r)
+		}
+	case "/logs":
+		if a.method(w, r, "GET") {
+			entries := a.Proxy.GetLogEntries(r.URL.Query().Get("signature"))
+			if entries == nil {
+				entries = []string{}
+			}
+			adminJSON(w, http.StatusOK, entries)
+		}
+	case "/har/flush":
+		if a.method(w, r, "POST") {
+			a.flushHAR(w)
+		}
+	case "/metrics":
+		if a.method(w, r, "GET") {
+			a.Proxy.Metrics.ServeHTTP(w, r)
+		}
+	case "/fingerprints/unknown":
+		if a.method(w, r, "GET") {
+			a.unknownFingerprints(w)
+		}
+	default:
+		adminError(w, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+	}
+}
+
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// Replies with an error and returns false if the request doesn't use the given method.
+func (a *AdminHandler) method(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		adminError(w, http.StatusMethodNotAllowed, "use "+method)
+		return false
+	}
+	return true
+}
+
+func (a *AdminHandler) tunnels(w http.ResponseWriter) {
+	tunnels := []adminTunnel{}
+	for _, t := range a.Proxy.Tunnels() {
+		tunnels = append(tunnels, adminTunnel{
+			Session:         t.Session,
+			Host:            t.Host,
+			SNI:             t.SNI,
+			Client:          t.Client,
+			CipherSignature: t.CipherSignature,
+			Start:           t.Start,
+			LastActivity:    t.LastActivity,
+			AgeSeconds:      t.Age().Seconds(),
+			BytesUp:         t.BytesUp,
+			BytesDown:       t.BytesDown,
+		})
+	}
+	adminJSON(w, http.StatusOK, tunnels)
+}
+
+func (a *AdminHandler) killTunnel(w http.ResponseWriter, r *http.Request) {
+	session, err := strconv.ParseInt(r.URL.Query().Get("session"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+	if !a.Proxy.KillTunnel(session) {
+		adminError(w, http.StatusNotFound, "no such tunnel")
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]int64{"killed": session})
+}
+
+func (a *AdminHandler) trace(w http.ResponseWriter, r *http.Request) {
+	if a.Tracer == nil {
+		adminError(w, http.StatusNotImplemented, "tracing is not configured")
+		return
+	}
+	var req adminTraceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Host) == "" {
+		adminError(w, http.StatusBadRequest, "expected {\"host\": ...}")
+		return
+	}
+
+	a.Tracer.RequestTrace(append([]string{req.Host}, req.Options...), req.Seconds)
+	adminJSON(w, http.StatusOK, req)
+}
+
+func (a *AdminHandler) flushCert(w http.ResponseWriter, r *http.Request) {
+	if a.Proxy.MITMCertConfig == nil {
+		adminError(w, http.StatusNotImplemented, "no certificate store is configured")
+		return
+	}
+	var req adminCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Host == "" {
+		adminError(w, http.StatusBadRequest, "expected {\"host\": ...}")
+		return
+	}
+
+	a.Proxy.MITMCertConfig.FlushCert(req.Host)
+	adminJSON(w, http.StatusOK, req)
+}
+
+func (a *AdminHandler) flushHAR(w http.ResponseWriter) {
+	if a.HARFile == "" {
+		adminError(w, http.StatusNotImplemented, "no HAR file is configured")
+		return
+	}
+
+	// Like FlushHARToDisk(), but don't hang the request if the aggregator isn't running (nothing
+	// has been logged yet) and its queue has filled up.
+	select {
+	case a.Proxy.harFlushRequest <- a.HARFile:
+		adminJSON(w, http.StatusAccepted, map[string]string{"file": a.HARFile})
+	default:
+		adminError(w, http.StatusServiceUnavailable, "HAR flush already pending")
+	}
+}
+
+func (a *AdminHandler) unknownFingerprints(w http.ResponseWriter) {
+	if a.Proxy.Fingerprints == nil {
+		adminError(w, http.StatusNotImplemented, "no fingerprint database is configured")
+		return
+	}
+	adminJSON(w, http.StatusOK, a.Proxy.Fingerprints.Unknown())
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
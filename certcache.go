@@ -0,0 +1,230 @@
+package goproxy
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Default for the zero MaxEntries of CertCacheLimits.
+const DefaultMaxCachedCerts = 10000
+
+// Number of independently locked shards in a certCache. Handshakes for hosts in different shards
+// never wait on each other.
+const certCacheShards = 32
+
+// Approximate memory used by a cached config besides the DER encoded certificates: the tls.Config
+// and the parsed leaf certificates.
+const certCacheEntryOverhead = 4096
+
+// CertCacheLimits bounds the certificates a GoproxyConfigServer keeps in memory. When a limit is
+// reached, the least recently used hosts are evicted; they're regenerated, or reloaded from the
+// Store, on their next handshake. The limits are divided evenly between the cache's shards, so
+// hosts may be evicted a little before the cache as a whole is full.
+type CertCacheLimits struct {
+	MaxEntries int           // Hosts cached. Defaults to DefaultMaxCachedCerts; negative is unlimited.
+	MaxBytes   int64         // Approximate memory used by the cached certificates. Zero is unlimited.
+	MaxAge     time.Duration // Time a host stays cached after its config was created. Zero is unlimited.
+}
+
+// CertCacheStats describes the certificate cache of a GoproxyConfigServer.
+type CertCacheStats struct {
+	Entries     int
+	Bytes       int64  // Approximate
+	Hits        uint64 // Lookups which found a cached config
+	Misses      uint64 // Lookups which didn't, including those which found an expired config
+	Evictions   uint64 // Hosts removed to stay within MaxEntries or MaxBytes
+	Expirations uint64 // Hosts removed because they were older than MaxAge
+}
+
+type certCacheEntry struct {
+	host  string
+	info  *HostInfo
+	size  int64
+	added time.Time
+}
+
+// A least recently used list of hosts, and the stats of the hosts hashed to it.
+type certCacheShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Most recently used first
+	bytes   int64
+	stats   CertCacheStats
+}
+
+// Caches the HostInfo of each host, sharded by host name. The zero value is ready to use.
+type certCache struct {
+	shards [certCacheShards]certCacheShard
+}
+
+// Returns the limits which apply to each shard, with the defaults filled in.
+func (l CertCacheLimits) perShard() CertCacheLimits {
+	if l.MaxEntries == 0 {
+		l.MaxEntries = DefaultMaxCachedCerts
+	}
+	if l.MaxEntries > 0 {
+		l.MaxEntries = (l.MaxEntries + certCacheShards - 1) / certCacheShards
+	}
+	if l.MaxBytes > 0 {
+		l.MaxBytes = (l.MaxBytes + certCacheShards - 1) / certCacheShards
+	}
+	return l
+}
+
+// Returns the index of the shard which holds host.
+func hostShard(host string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return h.Sum32() % certCacheShards
+}
+
+func (c *certCache) shard(host string) *certCacheShard {
+	return &c.shards[hostShard(host)]
+}
+
+// Returns the cached info for host, marking it as recently used. Expired hosts are removed.
+func (c *certCache) get(limits CertCacheLimits, host string) (*HostInfo, bool) {
+	return c.lookup(limits, host, true)
+}
+
+// Like get, but isn't counted as a hit or miss. Used to look a host up again after get.
+func (c *certCache) peek(limits CertCacheLimits, host string) (*HostInfo, bool) {
+	return c.lookup(limits, host, false)
+}
+
+func (c *certCache) lookup(limits CertCacheLimits, host string, count bool) (*HostInfo, bool) {
+	limits = limits.perShard()
+	s := c.shard(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[host]
+	if !ok {
+		if count {
+			s.stats.Misses++
+		}
+		return nil, false
+	}
+	entry := el.Value.(*certCacheEntry)
+	if limits.MaxAge > 0 && time.Since(entry.added) > limits.MaxAge {
+		s.remove(el)
+		s.stats.Expirations++
+		if count {
+			s.stats.Misses++
+		}
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	if count {
+		s.stats.Hits++
+	}
+	return entry.info, true
+}
+
+// Caches info for host, replacing any info already cached, and evicts hosts to stay within the
+// limits.
+func (c *certCache) set(limits CertCacheLimits, host string, info *HostInfo) {
+	c.add(limits, host, info, true)
+}
+
+// Caches info for host unless another info is already cached for it, which is returned instead.
+func (c *certCache) setIfAbsent(limits CertCacheLimits, host string, info *HostInfo) *HostInfo {
+	return c.add(limits, host, info, false)
+}
+
+func (c *certCache) add(limits CertCacheLimits, host string, info *HostInfo, replace bool) *HostInfo {
+	limits = limits.perShard()
+	s := c.shard(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[string]*list.Element)
+	}
+	if el, ok := s.entries[host]; ok {
+		if !replace {
+			s.lru.MoveToFront(el)
+			return el.Value.(*certCacheEntry).info
+		}
+		s.remove(el)
+	}
+
+	entry := &certCacheEntry{host: host, info: info, size: info.size(), added: time.Now()}
+	s.entries[host] = s.lru.PushFront(entry)
+	s.bytes += entry.size
+
+	// Evict from the back, but always keep the host just added.
+	for s.lru.Len() > 1 {
+		if limits.MaxEntries > 0 && s.lru.Len() > limits.MaxEntries ||
+			limits.MaxBytes > 0 && s.bytes > limits.MaxBytes {
+			s.remove(s.lru.Back())
+			s.stats.Evictions++
+			continue
+		}
+		break
+	}
+	return info
+}
+
+// Removes host from the cache.
+func (c *certCache) remove(host string) {
+	s := c.shard(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[host]; ok {
+		s.remove(el)
+	}
+}
+
+func (s *certCacheShard) remove(el *list.Element) {
+	entry := s.lru.Remove(el).(*certCacheEntry)
+	delete(s.entries, entry.host)
+	s.bytes -= entry.size
+}
+
+func (c *certCache) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (c *certCache) stats() CertCacheStats {
+	var stats CertCacheStats
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Entries += s.lru.Len()
+		stats.Bytes += s.bytes
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Evictions += s.stats.Evictions
+		stats.Expirations += s.stats.Expirations
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// Estimates the memory used by the host's config.
+func (info *HostInfo) size() int64 {
+	size := int64(certCacheEntryOverhead)
+	if info.Config == nil {
+		return size
+	}
+	for _, cert := range info.Config.Certificates {
+		for _, der := range cert.Certificate {
+			size += int64(len(der))
+		}
+	}
+	return size
+}
@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Returns n hosts which hash to the same shard.
+func sameShardHosts(c *certCache, n int) []string {
+	var hosts []string
+	shard := c.shard("host0.example.com")
+	for i := 0; len(hosts) < n; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		if c.shard(host) == shard {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func TestCertCacheLRU(t *testing.T) {
+	var c certCache
+	limits := CertCacheLimits{MaxEntries: 2 * certCacheShards}
+	hosts := sameShardHosts(&c, 3)
+
+	c.set(limits, hosts[0], &HostInfo{})
+	c.set(limits, hosts[1], &HostInfo{})
+	if _, ok := c.get(limits, hosts[0]); !ok {
+		t.Fatalf("%s not cached", hosts[0])
+	}
+
+	// hosts[1] is now the least recently used.
+	c.set(limits, hosts[2], &HostInfo{})
+	if _, ok := c.get(limits, hosts[1]); ok {
+		t.Errorf("least recently used host wasn't evicted")
+	}
+	for _, host := range []string{hosts[0], hosts[2]} {
+		if _, ok := c.get(limits, host); !ok {
+			t.Errorf("%s was evicted", host)
+		}
+	}
+
+	stats := c.stats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("got %+v, want 2 entries, 1 eviction, 3 hits and 1 miss", stats)
+	}
+
+	c.remove(hosts[0])
+	if c.len() != 1 {
+		t.Errorf("got %d entries after removal, want 1", c.len())
+	}
+}
+
+func TestCertCacheLimits(t *testing.T) {
+	var c certCache
+	info := func() *HostInfo {
+		return &HostInfo{Config: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{make([]byte, 1000)}}}}}
+	}
+
+	// Each entry takes 5096 bytes, so each shard can hold two.
+	limits := CertCacheLimits{MaxEntries: -1, MaxBytes: 12000 * certCacheShards}
+	hosts := sameShardHosts(&c, 3)
+	for _, host := range hosts {
+		c.set(limits, host, info())
+	}
+	if stats := c.stats(); stats.Entries != 2 || stats.Bytes != 2*(1000+certCacheEntryOverhead) || stats.Evictions != 1 {
+		t.Errorf("got %+v, want 2 entries of %d bytes and 1 eviction", stats, 1000+certCacheEntryOverhead)
+	}
+
+	// Without limits, nothing is evicted.
+	var unlimited certCache
+	limits = CertCacheLimits{MaxEntries: -1}
+	for i := 0; i < 1000; i++ {
+		unlimited.set(limits, fmt.Sprintf("host%d.example.com", i), &HostInfo{})
+	}
+	if unlimited.len() != 1000 {
+		t.Errorf("got %d entries, want 1000", unlimited.len())
+	}
+
+	// Expired hosts are removed when they're looked up.
+	limits = CertCacheLimits{MaxAge: 10 * time.Millisecond}
+	c.set(limits, "old.example.com", &HostInfo{})
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get(limits, "old.example.com"); ok {
+		t.Errorf("expired host was returned")
+	}
+	if stats := c.stats(); stats.Expirations != 1 {
+		t.Errorf("got %d expirations, want 1", stats.Expirations)
+	}
+}
+
+func TestCertCacheSetIfAbsent(t *testing.T) {
+	var c certCache
+	first, second := &HostInfo{}, &HostInfo{}
+
+	if got := c.setIfAbsent(CertCacheLimits{}, "example.com", first); got != first {
+		t.Errorf("setIfAbsent didn't cache a new host")
+	}
+	if got := c.setIfAbsent(CertCacheLimits{}, "example.com", second); got != first {
+		t.Errorf("setIfAbsent replaced a cached host")
+	}
+	c.set(CertCacheLimits{}, "example.com", second)
+	if got, _ := c.get(CertCacheLimits{}, "example.com"); got != second {
+		t.Errorf("set didn't replace a cached host")
+	}
+}
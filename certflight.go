@@ -0,0 +1,61 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+var errCertCallPanicked = errors.New("certificate generation panicked")
+
+// An in-progress or completed certWithCommonName call.
+type certCall struct {
+	wg     sync.WaitGroup
+	config *tls.Config
+	err    error
+}
+
+// The calls in progress for the hosts hashed to one shard.
+type certFlightShard struct {
+	mu    sync.Mutex
+	calls map[string]*certCall
+}
+
+// Coalesces concurrent certificate lookups for the same host, so that when a page opens many
+// connections to a new host at once, the origin is probed and a certificate is signed only once.
+// Sharded by host name like certCache. The zero value is ready to use.
+type certFlights struct {
+	shards [certCacheShards]certFlightShard
+}
+
+// Calls fn, unless a call for the same host is already in progress, in which case it waits for
+// that call and returns its result instead, including any error.
+func (g *certFlights) do(host string, fn func() (*tls.Config, error)) (*tls.Config, error) {
+	s := &g.shards[hostShard(host)]
+
+	s.mu.Lock()
+	if call, ok := s.calls[host]; ok {
+		s.mu.Unlock()
+		call.wg.Wait()
+		return call.config, call.err
+	}
+	if s.calls == nil {
+		s.calls = make(map[string]*certCall)
+	}
+	call := &certCall{}
+	call.wg.Add(1)
+	s.calls[host] = call
+	s.mu.Unlock()
+
+	// Release the waiters even if fn panics.
+	defer func() {
+		s.mu.Lock()
+		delete(s.calls, host)
+		s.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.err = errCertCallPanicked
+	call.config, call.err = fn()
+	return call.config, call.err
+}
@@ -0,0 +1,147 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/winstonprivacyinc/winston/intransport"
+)
+
+// Defaults for the zero fields of NegativeCachePolicy.
+const (
+	DefaultUntrustedCertRetry = 24 * time.Hour
+)
+
+// CertProber fetches the certificates origin servers present, which GoproxyConfigServer copies into
+// the certificates it signs. Set GoproxyConfigServer.Prober to fetch them some other way than
+// connecting directly, such as through an upstream proxy, or from a cache.
+type CertProber interface {
+	// ProbeCert returns the certificate chain presented by the server for host on the given
+	// port, leaf first.
+	ProbeCert(host, port string) ([]*x509.Certificate, error)
+
+	// VerifyCert returns an error if the chain returned by ProbeCert isn't trusted.
+	VerifyCert(chain []*x509.Certificate) error
+}
+
+// NegativeCachePolicy sets how long GoproxyConfigServer waits before probing an origin again after
+// a failure. Until then, clients are given the certificate or error from the failed probe.
+type NegativeCachePolicy struct {
+	// After an untrusted certificate, which is copied with its validity in the past so that
+	// clients reject it. Defaults to DefaultUntrustedCertRetry; negative probes every time.
+	Untrusted time.Duration
+
+	// After the probe itself fails. Zero probes every time.
+	ProbeError time.Duration
+}
+
+// Returns the policy with the defaults filled in.
+func (p NegativeCachePolicy) withDefaults() NegativeCachePolicy {
+	if p.Untrusted == 0 {
+		p.Untrusted = DefaultUntrustedCertRetry
+	}
+	if p.Untrusted < 0 {
+		p.Untrusted = 0
+	}
+	return p
+}
+
+// DialCertProber is the default CertProber. It connects to origin servers directly and verifies
+// their certificates with intransport, which fetches missing intermediate certificates.
+type DialCertProber struct {
+	Dialer         *net.Dialer
+	Timeout        time.Duration // For the connection and handshake. Zero uses the Dialer's timeout.
+	TimeoutRetries int           // Times a probe which timed out is retried
+	MinVersion     uint16
+	MaxVersion     uint16
+
+	// Verifies the chains. Defaults to the signer's shared InTransport.
+	Verifier *intransport.InTransport
+}
+
+// ProbeCert handshakes with the server, without verifying its certificate.
+func (p *DialCertProber) ProbeCert(host, port string) ([]*x509.Certificate, error) {
+	dialer := &net.Dialer{}
+	if p.Dialer != nil {
+		copied := *p.Dialer
+		dialer = &copied
+	}
+	if p.Timeout > 0 {
+		dialer.Timeout = p.Timeout
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         p.MinVersion,
+		MaxVersion:         p.MaxVersion,
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), config)
+	for retry := 0; err != nil && retry < p.TimeoutRetries; retry++ {
+		// Timeouts should be rare but they aren't. CoreDNS appears to single thread some lookups
+		// (perhaps when loading the hosts file) resulting in a stampede timeout. A slight delay is
+		// better than a failed page load.
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			break
+		}
+		start := time.Now()
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), config)
+		if err != nil {
+			fmt.Printf("[DEBUG] Signer.go - Error while retrying. %s %s: %v\n", host, err, time.Since(start))
+		} else {
+			fmt.Printf("[INFO] Signer.go - Retry succeeded. %s: %v\n", host, time.Since(start))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s presented no certificates", host)
+	}
+	return chain, nil
+}
+
+// VerifyCert checks the chain, fetching missing intermediates.
+func (p *DialCertProber) VerifyCert(chain []*x509.Certificate) error {
+	verifier := p.Verifier
+	if verifier == nil {
+		verifier = certtransport
+	}
+	rawCerts := make([][]byte, len(chain))
+	for i, cert := range chain {
+		rawCerts[i] = cert.Raw
+	}
+	if verifier == nil {
+		return verifyChain(chain)
+	}
+	return verifier.VerifyPeerCertificate(rawCerts, nil)
+}
+
+// Verifies a chain against the system roots, for when there's no InTransport.
+func verifyChain(chain []*x509.Certificate) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{Intermediates: intermediates})
+	return err
+}
+
+// Returns the prober used to fetch origin certificates.
+func (c *GoproxyConfigServer) prober() CertProber {
+	if c.Prober != nil {
+		return c.Prober
+	}
+	_, maxVersion := c.versions()
+	return &DialCertProber{
+		Dialer:         c.bypassDnsDialer,
+		TimeoutRetries: 1,
+		MinVersion:     tls.VersionTLS10,
+		MaxVersion:     maxVersion,
+	}
+}
@@ -0,0 +1,222 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CertStore persists the certificates a GoproxyConfigServer generates, so that they survive a
+// restart. Implementations must be safe for concurrent use, but are never called concurrently
+// for the same host.
+type CertStore interface {
+	// Load returns the certificates stored for host, or nil if there are none.
+	Load(host string) (*StoredCert, error)
+	Save(host string, cert *StoredCert) error
+	Delete(host string) error
+}
+
+// StoredCert is a host's entry in a CertStore. An entry without Leaves records a failed probe
+// of the origin, which isn't retried until NextAttempt.
+type StoredCert struct {
+	Root        []byte // SHA-256 hash of the root certificate which signed the leaves
+	Leaves      []StoredLeaf
+	LastVerify  time.Time
+	NextAttempt time.Time
+	ProbeError  string // Why the origin couldn't be probed, if there are no Leaves
+}
+
+// StoredLeaf is a leaf certificate and its private key.
+type StoredLeaf struct {
+	Chain [][]byte // DER encoded certificates, leaf first
+	Key   []byte   // PKCS #8 encoded private key
+}
+
+// DiskCertStore is a CertStore which keeps each host's certificates in its own file.
+type DiskCertStore struct {
+	dir string
+}
+
+// NewDiskCertStore returns a store which keeps its files in dir, creating it if needed.
+func NewDiskCertStore(dir string) (*DiskCertStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCertStore{dir: dir}, nil
+}
+
+func (s *DiskCertStore) path(host string) string {
+	return filepath.Join(s.dir, url.QueryEscape(host)+".cert")
+}
+
+func (s *DiskCertStore) Load(host string) (*StoredCert, error) {
+	buf, err := ioutil.ReadFile(s.path(host))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cert StoredCert
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&cert); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", s.path(host), err)
+	}
+	return &cert, nil
+}
+
+// Save writes the entry to a temporary file and renames it into place, so a crash never leaves
+// a partially written entry behind.
+func (s *DiskCertStore) Save(host string, cert *StoredCert) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cert); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(host))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *DiskCertStore) Delete(host string) error {
+	err := os.Remove(s.path(host))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns the hash identifying the root certificate in stored entries.
+func (c *GoproxyConfigServer) rootHash() []byte {
+	sum := sha256.Sum256(c.Root.Raw)
+	return sum[:]
+}
+
+// Loads host's certificates from the store and caches them. Entries signed by a different root,
+// or which have expired and aren't being held back from a retry, are discarded. A failed probe
+// is loaded as an entry without a Config, which gives the probe error until NextAttempt.
+func (c *GoproxyConfigServer) loadHost(host string) (*HostInfo, bool) {
+	stored, err := c.Store.Load(host)
+	if err != nil {
+		fmt.Printf("[WARN] Couldn't load stored certificate for %s: %v\n", host, err)
+		return nil, false
+	}
+	if stored == nil {
+		return nil, false
+	}
+
+	if len(stored.Leaves) == 0 {
+		if !time.Now().Before(stored.NextAttempt) {
+			c.Store.Delete(host)
+			return nil, false
+		}
+		probeErr := fmt.Errorf("couldn't probe %s", host)
+		if stored.ProbeError != "" {
+			probeErr = errors.New(stored.ProbeError)
+		}
+		info := &HostInfo{NextAttempt: stored.NextAttempt, probeErr: probeErr}
+		return c.hosts.setIfAbsent(c.CacheLimits, host, info), true
+	}
+
+	leaves, err := stored.leaves()
+	if err == nil && !bytes.Equal(stored.Root, c.rootHash()) {
+		err = fmt.Errorf("signed by a different root certificate")
+	}
+	if err == nil && time.Now().After(leaves[0].Leaf.NotAfter) && time.Now().After(stored.NextAttempt) {
+		err = fmt.Errorf("expired")
+	}
+	if err != nil {
+		c.Store.Delete(host)
+		return nil, false
+	}
+
+	info := &HostInfo{
+		LastVerify:  stored.LastVerify,
+		NextAttempt: stored.NextAttempt,
+		Config:      c.hostConfig(host, leaves),
+	}
+
+	// Another goroutine may have generated a certificate in the meantime.
+	return c.hosts.setIfAbsent(c.CacheLimits, host, info), true
+}
+
+// Writes host's certificates, or the failed probe which is holding them back, to the store if
+// there is one. The caller must hold info.mu.
+func (c *GoproxyConfigServer) storeHost(host string, info *HostInfo) {
+	if c.Store == nil {
+		return
+	}
+
+	stored := &StoredCert{
+		Root:        c.rootHash(),
+		LastVerify:  info.LastVerify,
+		NextAttempt: info.NextAttempt,
+	}
+	if info.Config == nil {
+		if info.probeErr != nil {
+			stored.ProbeError = info.probeErr.Error()
+		}
+		if err := c.Store.Save(host, stored); err != nil {
+			fmt.Printf("[WARN] Couldn't store probe error for %s: %v\n", host, err)
+		}
+		return
+	}
+
+	for _, cert := range info.Config.Certificates {
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			fmt.Printf("[WARN] Couldn't store certificate for %s: %v\n", host, err)
+			return
+		}
+		stored.Leaves = append(stored.Leaves, StoredLeaf{Chain: cert.Certificate, Key: key})
+	}
+
+	if err := c.Store.Save(host, stored); err != nil {
+		fmt.Printf("[WARN] Couldn't store certificate for %s: %v\n", host, err)
+	}
+}
+
+// Decodes the stored leaves into certificates.
+func (s *StoredCert) leaves() ([]*tls.Certificate, error) {
+	if len(s.Leaves) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+
+	leaves := make([]*tls.Certificate, len(s.Leaves))
+	for i, stored := range s.Leaves {
+		if len(stored.Chain) == 0 {
+			return nil, fmt.Errorf("empty certificate chain")
+		}
+		leaf, err := x509.ParseCertificate(stored.Chain[0])
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKCS8PrivateKey(stored.Key)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = &tls.Certificate{Certificate: stored.Chain, PrivateKey: key, Leaf: leaf}
+	}
+	return leaves, nil
+}
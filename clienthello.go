@@ -0,0 +1,354 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/inconshreveable/go-vhost"
+)
+
+// TLS extensions read from the ClientHello.
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extPointFormats        uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+	extKeyShare            uint16 = 51
+)
+
+var errMalformedClientHello = errors.New("malformed TLS ClientHello")
+
+// Returns true for the reserved GREASE values (0x0a0a, 0x1a1a ... 0xfafa) which BoringSSL based
+// clients sprinkle through their ClientHello at random. They're excluded from fingerprints.
+// Ref: https://tools.ietf.org/html/rfc8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ClientHello is the first message a TLS client sends, parsed in full, including the TLS 1.3
+// extensions which vhost.ClientHelloMsg ignores. It can't be modified once parsed; the getters
+// return copies. GREASE values are left out of every list.
+//
+// Connect handlers find the ClientHello of a TLS connection in ctx.ClientHello, for example:
+//
+//	if hello := ctx.ClientHello; hello != nil && hello.MaxVersion() < tls.VersionTLS12 {
+//		return REJECT
+//	}
+type ClientHello struct {
+	raw               []byte
+	vers              uint16
+	serverName        string
+	ciphers           []uint16
+	compression       []uint8
+	extensions        []uint16
+	curves            []uint16
+	points            []uint8
+	signatureAlgs     []uint16
+	alpn              []string
+	supportedVersions []uint16
+	keyShares         []uint16
+}
+
+// ParseClientHello parses a ClientHello handshake message, without the record header, as found
+// in vhost.ClientHelloMsg.Raw.
+func ParseClientHello(raw []byte) (*ClientHello, error) {
+	s := helloReader(raw)
+	h := &ClientHello{raw: append([]byte(nil), raw...)}
+
+	if typ, ok := s.uint8(); !ok || typ != 1 {
+		return nil, errMalformedClientHello
+	}
+	if _, ok := s.bytes(3); !ok {
+		return nil, errMalformedClientHello
+	}
+	vers, ok := s.uint16()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	h.vers = vers
+	if _, ok := s.bytes(32); !ok { // Random
+		return nil, errMalformedClientHello
+	}
+	if _, ok := s.vector8(); !ok { // Session ID
+		return nil, errMalformedClientHello
+	}
+
+	ciphers, ok := s.vector16()
+	if !ok || !ciphers.uint16s(&h.ciphers) {
+		return nil, errMalformedClientHello
+	}
+	compression, ok := s.vector8()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	h.compression = append([]uint8(nil), compression...)
+
+	// Extensions are optional.
+	if len(s) == 0 {
+		return h, nil
+	}
+	extensions, ok := s.vector16()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		data, ok := extensions.vector16()
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		h.extensions = append(h.extensions, typ)
+		if !h.parseExtension(typ, data) {
+			return nil, errMalformedClientHello
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, data helloReader) bool {
+	switch typ {
+	case extServerName:
+		names, ok := data.vector16()
+		if !ok {
+			return false
+		}
+		for len(names) > 0 {
+			nameType, ok := names.uint8()
+			if !ok {
+				return false
+			}
+			name, ok := names.vector16()
+			if !ok {
+				return false
+			}
+			if nameType == 0 && h.serverName == "" {
+				h.serverName = string(name)
+			}
+		}
+	case extSupportedGroups:
+		list, ok := data.vector16()
+		return ok && list.uint16s(&h.curves)
+	case extPointFormats:
+		list, ok := data.vector8()
+		if !ok {
+			return false
+		}
+		h.points = append([]uint8(nil), list...)
+	case extSignatureAlgorithms:
+		list, ok := data.vector16()
+		return ok && list.uint16s(&h.signatureAlgs)
+	case extALPN:
+		list, ok := data.vector16()
+		if !ok {
+			return false
+		}
+		for len(list) > 0 {
+			proto, ok := list.vector8()
+			if !ok {
+				return false
+			}
+			h.alpn = append(h.alpn, string(proto))
+		}
+	case extSupportedVersions:
+		list, ok := data.vector8()
+		return ok && list.uint16s(&h.supportedVersions)
+	case extKeyShare:
+		shares, ok := data.vector16()
+		if !ok {
+			return false
+		}
+		for len(shares) > 0 {
+			group, ok := shares.uint16()
+			if !ok {
+				return false
+			}
+			if _, ok := shares.vector16(); !ok {
+				return false
+			}
+			h.keyShares = append(h.keyShares, group)
+		}
+	}
+	return true
+}
+
+// Parses the ClientHello sniffed by vhost, or returns nil if there isn't one.
+func clientHelloFromVhost(msg *vhost.ClientHelloMsg) *ClientHello {
+	if msg == nil {
+		return nil
+	}
+	h, err := ParseClientHello(msg.Raw)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// Raw returns the handshake message the ClientHello was parsed from.
+func (h *ClientHello) Raw() []byte {
+	return append([]byte(nil), h.raw...)
+}
+
+// Version returns the legacy version field, which is TLS 1.2 for TLS 1.3 clients. See
+// MaxVersion.
+func (h *ClientHello) Version() uint16 {
+	return h.vers
+}
+
+// SupportedVersions returns the versions offered in the supported_versions extension, in the
+// client's order of preference. Empty if the client didn't send the extension, which clients
+// without TLS 1.3 support usually omit.
+func (h *ClientHello) SupportedVersions() []uint16 {
+	return withoutGREASE(h.supportedVersions)
+}
+
+// MaxVersion returns the highest TLS version the client offered, such as tls.VersionTLS13.
+func (h *ClientHello) MaxVersion() uint16 {
+	vers := h.vers
+	if versions := h.SupportedVersions(); len(versions) > 0 {
+		vers = 0
+		for _, v := range versions {
+			if v > vers {
+				vers = v
+			}
+		}
+	}
+	return vers
+}
+
+// ServerName returns the name sent in the server_name extension (SNI), if any.
+func (h *ClientHello) ServerName() string {
+	return h.serverName
+}
+
+// CipherSuites returns the offered cipher suites, in the client's order of preference.
+func (h *ClientHello) CipherSuites() []uint16 {
+	return withoutGREASE(h.ciphers)
+}
+
+// CompressionMethods returns the offered compression methods.
+func (h *ClientHello) CompressionMethods() []uint8 {
+	return append([]uint8(nil), h.compression...)
+}
+
+// Extensions returns the types of the extensions sent, in the order they were sent.
+func (h *ClientHello) Extensions() []uint16 {
+	return withoutGREASE(h.extensions)
+}
+
+// HasExtension returns true if the client sent an extension of the given type.
+func (h *ClientHello) HasExtension(typ uint16) bool {
+	for _, ext := range h.extensions {
+		if ext == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// ALPNProtocols returns the application protocols offered, such as "h2" and "http/1.1", in the
+// client's order of preference.
+func (h *ClientHello) ALPNProtocols() []string {
+	return append([]string(nil), h.alpn...)
+}
+
+// OffersALPN returns true if the client offered the application protocol proto.
+func (h *ClientHello) OffersALPN(proto string) bool {
+	for _, p := range h.alpn {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportedGroups returns the key exchange groups (elliptic curves) the client supports.
+func (h *ClientHello) SupportedGroups() []uint16 {
+	return withoutGREASE(h.curves)
+}
+
+// KeyShareGroups returns the groups the client sent TLS 1.3 key shares for.
+func (h *ClientHello) KeyShareGroups() []uint16 {
+	return withoutGREASE(h.keyShares)
+}
+
+// PointFormats returns the elliptic curve point formats the client supports.
+func (h *ClientHello) PointFormats() []uint8 {
+	return append([]uint8(nil), h.points...)
+}
+
+// SignatureAlgorithms returns the signature schemes the client accepts, in its order of
+// preference.
+func (h *ClientHello) SignatureAlgorithms() []uint16 {
+	return withoutGREASE(h.signatureAlgs)
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// A cursor over a TLS message. Each read advances past the value it returns.
+type helloReader []byte
+
+func (s *helloReader) bytes(n int) (helloReader, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	b := (*s)[:n]
+	*s = (*s)[n:]
+	return b, true
+}
+
+func (s *helloReader) uint8() (uint8, bool) {
+	b, ok := s.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (s *helloReader) uint16() (uint16, bool) {
+	b, ok := s.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (s *helloReader) vector8() (helloReader, bool) {
+	n, ok := s.uint8()
+	if !ok {
+		return nil, false
+	}
+	return s.bytes(int(n))
+}
+
+func (s *helloReader) vector16() (helloReader, bool) {
+	n, ok := s.uint16()
+	if !ok {
+		return nil, false
+	}
+	return s.bytes(int(n))
+}
+
+// Appends the rest of s, read as a list of uint16s, to out.
+func (s helloReader) uint16s(out *[]uint16) bool {
+	if len(s)%2 != 0 {
+		return false
+	}
+	for len(s) > 0 {
+		v, _ := s.uint16()
+		*out = append(*out, v)
+	}
+	return true
+}
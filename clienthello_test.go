@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestParseClientHello(t *testing.T) {
+	msg := readClientHello(t, "clienthello_chrome_grease.bin")
+	h, err := ParseClientHello(msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Version() != tls.VersionTLS12 || h.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("got versions %#x, %#x", h.Version(), h.MaxVersion())
+	}
+	if got, want := h.SupportedVersions(), []uint16{tls.VersionTLS13, tls.VersionTLS12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SupportedVersions() = %#x, want %#x", got, want)
+	}
+	if h.ServerName() != "www.example.com" {
+		t.Errorf("ServerName() = %q", h.ServerName())
+	}
+	if got, want := h.ALPNProtocols(), []string{"h2", "http/1.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ALPNProtocols() = %q, want %q", got, want)
+	}
+	if !h.OffersALPN("http/1.1") || h.OffersALPN("http/1.0") {
+		t.Errorf("OffersALPN() is wrong")
+	}
+	if got, want := h.KeyShareGroups(), []uint16{uint16(tls.X25519)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyShareGroups() = %v, want %v", got, want)
+	}
+	if got, want := h.SupportedGroups(), []uint16{uint16(tls.X25519), uint16(tls.CurveP256), uint16(tls.CurveP384)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SupportedGroups() = %v, want %v", got, want)
+	}
+	if got := h.SignatureAlgorithms(); len(got) != 8 || got[0] != uint16(tls.ECDSAWithP256AndSHA256) {
+		t.Errorf("SignatureAlgorithms() = %#x", got)
+	}
+	if len(h.CipherSuites()) != 15 || len(h.Extensions()) != 16 {
+		t.Errorf("got %d cipher suites and %d extensions, want 15 and 16", len(h.CipherSuites()), len(h.Extensions()))
+	}
+	if !h.HasExtension(extKeyShare) || h.HasExtension(0x0029) {
+		t.Errorf("HasExtension() is wrong")
+	}
+	if !reflect.DeepEqual(h.PointFormats(), []uint8{0}) || !reflect.DeepEqual(h.CompressionMethods(), []uint8{0}) {
+		t.Errorf("got point formats %v and compression methods %v", h.PointFormats(), h.CompressionMethods())
+	}
+
+	// Getters return copies.
+	h.CipherSuites()[0] = 0
+	h.ALPNProtocols()[0] = "spdy/3"
+	h.Raw()[0] = 0
+	if h.CipherSuites()[0] != tls.TLS_AES_128_GCM_SHA256 || h.ALPNProtocols()[0] != "h2" || h.Raw()[0] != 1 {
+		t.Errorf("ClientHello was modified through a getter")
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	msg := readClientHello(t, "clienthello_openssl.bin")
+	for _, n := range []int{0, 1, 40, len(msg.Raw) - 1} {
+		if _, err := ParseClientHello(msg.Raw[:n]); err == nil {
+			t.Errorf("parsed ClientHello truncated to %d bytes", n)
+		}
+	}
+
+	// Extensions are optional.
+	raw := append([]byte{1, 0, 0, 41, 3, 3}, make([]byte, 32)...)
+	raw = append(raw, 0, 0, 2, 0, 0x2f, 1, 0)
+	h, err := ParseClientHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.MaxVersion() != tls.VersionTLS12 || len(h.Extensions()) != 0 || h.JA4() != "t12i010000_ba72b8082249_000000000000" {
+		t.Errorf("got version %#x, extensions %v and JA4 %s", h.MaxVersion(), h.Extensions(), h.JA4())
+	}
+}
@@ -0,0 +1,197 @@
+package goproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnLimits caps the inbound connections the proxy accepts. Connections over a limit are closed
+// as soon as they are accepted, before any bytes are read from them, and counted in Metrics.
+// Zero values are unlimited.
+type ConnLimits struct {
+	MaxConns      int     // Concurrent connections
+	MaxConnRate   float64 // New connections per second
+	MaxConnsPerIP int     // Concurrent connections from a single client IP
+	MaxRatePerIP  float64 // New connections per second from a single client IP
+}
+
+// Reasons a connection was rejected, reported in the goproxy_rejected_connections_total metric.
+const (
+	RejectedMaxConns      = "max_conns"
+	RejectedMaxConnRate   = "max_conn_rate"
+	RejectedMaxConnsPerIP = "max_conns_per_ip"
+	RejectedMaxRatePerIP  = "max_rate_per_ip"
+)
+
+// How often idle per-IP entries are removed from a connLimiter.
+const connLimiterSweepInterval = time.Minute
+
+// Counts the open connections and connection rate of a client, or of the proxy as a whole. The
+// rate is a token bucket holding up to one second of connections.
+type connCounter struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+// Refills the bucket. Returns false if it holds less than a token.
+func (c *connCounter) refill(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := connRateBurst(rate)
+	if c.last.IsZero() {
+		c.tokens = burst
+	} else {
+		c.tokens += now.Sub(c.last).Seconds() * rate
+		if c.tokens > burst {
+			c.tokens = burst
+		}
+	}
+	c.last = now
+	return c.tokens >= 1
+}
+
+// Takes a token from a bucket which refill found wasn't empty.
+func (c *connCounter) take(rate float64) {
+	if rate > 0 {
+		c.tokens--
+	}
+}
+
+// Returns true once the bucket would have refilled, so forgetting the counter loses nothing.
+func (c *connCounter) idle(rate float64, now time.Time) bool {
+	if c.conns > 0 {
+		return false
+	}
+	if rate <= 0 || c.last.IsZero() {
+		return true
+	}
+	return now.Sub(c.last).Seconds()*rate >= connRateBurst(rate)
+}
+
+// Connections allowed in a burst at the given rate: one second's worth, and at least one.
+func connRateBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// Enforces ConnLimits. The zero value is ready to use.
+type connLimiter struct {
+	mu        sync.Mutex
+	total     connCounter
+	perIP     map[string]*connCounter
+	lastSweep time.Time
+}
+
+// Admits a new connection from ip, returning the reason it was rejected if it is over a limit.
+// Every limit is checked before any tokens are taken, so a rejected connection doesn't count
+// against the rate limits. If ip is empty only the proxy-wide limits are applied, and the
+// client's limits must be applied separately with admitIP. Every admitted connection must be
+// released.
+func (l *connLimiter) admit(limits ConnLimits, ip string) (string, bool) {
+	return l.check(limits, ip, true)
+}
+
+// Applies the per-client limits to a connection whose proxy-wide limits were already applied by
+// admit. Used when the client's address isn't known until after the connection is accepted.
+// Every admitted connection must be released with releaseIP.
+func (l *connLimiter) admitIP(limits ConnLimits, ip string) (string, bool) {
+	return l.check(limits, ip, false)
+}
+
+func (l *connLimiter) check(limits ConnLimits, ip string, total bool) (string, bool) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > connLimiterSweepInterval {
+		for key, c := range l.perIP {
+			if c.idle(limits.MaxRatePerIP, now) {
+				delete(l.perIP, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	var client *connCounter
+	if ip != "" {
+		if l.perIP == nil {
+			l.perIP = make(map[string]*connCounter)
+		}
+		var ok bool
+		if client, ok = l.perIP[ip]; !ok {
+			client = &connCounter{}
+			l.perIP[ip] = client
+		}
+	}
+
+	switch {
+	case client != nil && limits.MaxConnsPerIP > 0 && client.conns >= limits.MaxConnsPerIP:
+		return RejectedMaxConnsPerIP, false
+	case total && limits.MaxConns > 0 && l.total.conns >= limits.MaxConns:
+		return RejectedMaxConns, false
+	case client != nil && !client.refill(limits.MaxRatePerIP, now):
+		return RejectedMaxRatePerIP, false
+	case total && !l.total.refill(limits.MaxConnRate, now):
+		return RejectedMaxConnRate, false
+	}
+
+	if client != nil {
+		client.take(limits.MaxRatePerIP)
+		client.conns++
+	}
+	if total {
+		l.total.take(limits.MaxConnRate)
+		l.total.conns++
+	}
+	return "", true
+}
+
+// Releases a connection admitted by admit.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total.conns--
+	l.releaseClient(ip)
+}
+
+// Releases a connection admitted by admitIP.
+func (l *connLimiter) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseClient(ip)
+}
+
+func (l *connLimiter) releaseClient(ip string) {
+	if client, ok := l.perIP[ip]; ok {
+		client.conns--
+	}
+}
+
+// Returns the IP address a client connected from.
+func remoteIP(c net.Conn) string {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// Closes a connection which was refused by the connection limits. TCP connections are reset
+// rather than closed gracefully, so that a flood doesn't leave sockets lingering in TIME_WAIT.
+func rejectConn(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	var l connLimiter
+	limits := ConnLimits{MaxConns: 3, MaxConnsPerIP: 2}
+
+	for i := 0; i < 2; i++ {
+		if reason, ok := l.admit(limits, "10.0.0.1"); !ok {
+			t.Fatalf("connection %d rejected: %s", i, reason)
+		}
+	}
+	if reason, _ := l.admit(limits, "10.0.0.1"); reason != RejectedMaxConnsPerIP {
+		t.Errorf("got %q, want %q", reason, RejectedMaxConnsPerIP)
+	}
+	if _, ok := l.admit(limits, "10.0.0.2"); !ok {
+		t.Errorf("connection from another client rejected")
+	}
+	if reason, _ := l.admit(limits, "10.0.0.3"); reason != RejectedMaxConns {
+		t.Errorf("got %q, want %q", reason, RejectedMaxConns)
+	}
+
+	l.release("10.0.0.1")
+	if _, ok := l.admit(limits, "10.0.0.1"); !ok {
+		t.Errorf("connection rejected after release")
+	}
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	var l connLimiter
+	limits := ConnLimits{MaxRatePerIP: 20, MaxConnRate: 30}
+
+	admitted := 0
+	for i := 0; i < 25; i++ {
+		if _, ok := l.admit(limits, "10.0.0.1"); ok {
+			admitted++
+			l.release("10.0.0.1")
+		}
+	}
+	if admitted != 20 {
+		t.Errorf("admitted %d connections in a burst, want 20", admitted)
+	}
+	if reason, _ := l.admit(limits, "10.0.0.1"); reason != RejectedMaxRatePerIP {
+		t.Errorf("got %q, want %q", reason, RejectedMaxRatePerIP)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, ok := l.admit(limits, "10.0.0.2"); !ok {
+			t.Fatalf("connection %d from another client rejected", i)
+		}
+	}
+	if reason, _ := l.admit(limits, "10.0.0.2"); reason != RejectedMaxConnRate {
+		t.Errorf("got %q, want %q", reason, RejectedMaxConnRate)
+	}
+
+	// Tokens are refilled over time.
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := l.admit(limits, "10.0.0.1"); !ok {
+		t.Errorf("connection rejected after refill")
+	}
+}
+
+func TestConnLimiterRejectionTakesNoTokens(t *testing.T) {
+	var l connLimiter
+	limits := ConnLimits{MaxRatePerIP: 2, MaxConnRate: 2}
+
+	for i := 0; i < 2; i++ {
+		if reason, ok := l.admit(limits, "10.0.0.1"); !ok {
+			t.Fatalf("connection %d rejected: %s", i, reason)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if reason, _ := l.admit(limits, "10.0.0.2"); reason != RejectedMaxConnRate {
+			t.Errorf("got %q, want %q", reason, RejectedMaxConnRate)
+		}
+	}
+	if tokens := l.perIP["10.0.0.2"].tokens; tokens != 2 {
+		t.Errorf("client has %v tokens after rejected connections, want 2", tokens)
+	}
+}
+
+func TestConnLimiterPerIPAfterAdmit(t *testing.T) {
+	var l connLimiter
+	limits := ConnLimits{MaxConns: 2, MaxConnsPerIP: 1}
+
+	// The proxy-wide limits are applied first, then the client's once its address is known.
+	if _, ok := l.admit(limits, ""); !ok {
+		t.Fatalf("connection rejected")
+	}
+	if _, ok := l.admitIP(limits, "10.0.0.1"); !ok {
+		t.Fatalf("connection rejected by client limits")
+	}
+	if _, ok := l.admit(limits, ""); !ok {
+		t.Fatalf("second connection rejected")
+	}
+	if reason, _ := l.admitIP(limits, "10.0.0.1"); reason != RejectedMaxConnsPerIP {
+		t.Errorf("got %q, want %q", reason, RejectedMaxConnsPerIP)
+	}
+	l.release("")
+	if reason, _ := l.admit(limits, ""); reason != "" {
+		t.Errorf("connection rejected after release: %s", reason)
+	}
+	if reason, _ := l.admit(limits, ""); reason != RejectedMaxConns {
+		t.Errorf("got %q, want %q", reason, RejectedMaxConns)
+	}
+
+	l.releaseIP("10.0.0.1")
+	if _, ok := l.admitIP(limits, "10.0.0.1"); !ok {
+		t.Errorf("connection rejected after releaseIP")
+	}
+}
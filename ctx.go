@@ -47,7 +47,9 @@ var NonHTTPRequest = "nonhttprequest"
 // `FakeDestinationDNS` and `LogToHARFile` will have no effect.
 type ProxyCtx struct {
 	Method               string                                         // FIXME: document this
-	SourceIP             string                                         // FIXME: document this
+	SourceIP             string                                         // Address (ip:port) of the client. Equivalent to ClientAddr.String().
+	ClientAddr           net.Addr                                       // Address of the client, taken from the accepted connection (or its PROXY protocol header).
+	LocalAddr            net.Addr                                       // Local address the client connection was accepted on, ie: the intercepted destination under TPROXY.
 	IsSecure             bool                                           // Whether we are handling an HTTPS request with the client
 	IsThroughMITM        bool                                           // Whether the current request is currently being MITM'd
 	IsThroughTunnel      bool                                           // Whether the current request is going through a CONNECT tunnel, doing HTTP calls (non-secure)
@@ -56,6 +58,7 @@ type ProxyCtx struct {
 	host                 string                                         // Sniffed and non-sniffed hosts, cached here.
 	sniHost              string                                         // FIXME: document this
 	sniffedTLS           bool                                           // FIXME: document this
+	serverName           string                                         // Server name in the client's TLS ClientHello, if any. Unlike sniHost, never replaced by the original destination.
 	MITMCertConfig       *GoproxyConfigServer                           // FIXME: document this
 	connectScheme        string                                         // FIXME: document this
 	OriginalRequest      *http.Request                                  // OriginalRequest holds a copy of the request before doing some HTTP tunnelling through CONNECT, or doing a man-in-the-middle attack.
@@ -78,6 +81,10 @@ type ProxyCtx struct {
 	Tlsfailure           func(ctx *ProxyCtx, untrustedCertificate bool) // Closure to alert listeners that a TLS handshake failed RLS 6-29-2017 References to persistent caches for statistics collection RLS 7-5-2017
 	IgnoreCounter        bool                                           // if true, this request won't be counted (used for streaming)
 	CipherSignature      string                                         // Client signature https://blog.squarelemon.com/tls-fingerprinting/
+	ClientHello          *ClientHello                                   // The client's TLS ClientHello. Nil for connections which aren't TLS.
+	JA3                  string                                         // JA3 fingerprint of the client's TLS ClientHello https://github.com/salesforce/ja3
+	JA4                  string                                         // JA4 fingerprint of the client's TLS ClientHello https://github.com/FoxIO-LLC/ja4
+	DeviceLabel          string                                         // Label of the client's fingerprint in Proxy.Fingerprints, if known
 	NewBodyLength        int                                            // FIXME: document this.
 	VerbosityLevel       uint16                                         // FIXME: document this.
 	DeviceType           int                                            // 11/2/2017 - Used for replacement macros (user agents)
@@ -97,6 +104,9 @@ type ProxyCtx struct {
 	CookiesModified      int                                            // # of cookies blocked or modified for the current request. Used for logging.
 	ElementsModified     int                                            // # of page elements removed or modified for the current request. Used for logging.
 	fitter               *plumb.Fitter
+	clientConn           net.Conn // Connection as accepted by the listener. Used to look up the original destination.
+	originalDestination  string   // Cached result of OriginalDestination()
+	destinationResolved  bool     // Set once OriginalDestination() has been looked up, even if it failed
 }
 
 var fitter *plumb.Fitter
@@ -153,6 +163,7 @@ func (ctx *ProxyCtx) SNIHost() string {
 
 	// Sniff the host
 	sniHost := tlsConn.Host()
+	ctx.serverName = sniHost
 
 	if sniHost != "" {
 		// Fix: if host hasn't been set yet, then the original code defaults to port
@@ -186,6 +197,17 @@ func (ctx *ProxyCtx) Host() string {
 	return ctx.host
 }
 
+// OriginalDestination returns the address (host:port) the client originally connected to, as
+// reported by a PROXY protocol header or the proxy's DestinationResolver, or "" if it can't be
+// determined. Unlike Host(), this is never a hostname. The result is cached on the context.
+func (ctx *ProxyCtx) OriginalDestination() string {
+	if !ctx.destinationResolved && ctx.clientConn != nil && ctx.Proxy != nil {
+		ctx.originalDestination = ctx.Proxy.originalDestination(ctx.clientConn)
+		ctx.destinationResolved = true
+	}
+	return ctx.originalDestination
+}
+
 // SetDestinationHost sets the "host:port" to which you want to
 // FORWARD or MITM a CONNECT request.  Otherwise defaults to what was
 // in the `CONNECT` request. If you call `SNIHost()` to sniff SNI,
@@ -1057,12 +1079,14 @@ func (ctx *ProxyCtx) ForwardConnect() error {
 
 	//fmt.Println("[DEBUG] ForwardConnect(): ctx.Method", ctx.Method, "host", ctx.host)
 
+	dnsbypassctx = ctx.proxyProtocolContext(dnsbypassctx)
 	targetSiteConn, err := ctx.Proxy.connectDialContext(dnsbypassctx, "tcp", ctx.host)
 	if err != nil {
 		fmt.Printf("[DEBUG] ForwardConnect() - error while dialing: error - %+v\n", err)
 		ctx.httpError(err)
 		return err
 	}
+	ctx.countForwarded()
 
 	// TEST:
 	//fmt.Println("[DEBUG] ForwardConnect() - Making connect decision", ctx.host, ctx.IsSecure)
@@ -1079,9 +1103,7 @@ func (ctx *ProxyCtx) ForwardConnect() error {
 	//fmt.Println("[DEBUG] ForwardConnect() - Fusing client connection to host", ctx.host)
 	//}
 
-	fitter.Fit(ctx.Conn, targetSiteConn)
-	ctx.Conn.Close()
-	targetSiteConn.Close()
+	ctx.fuse(targetSiteConn, 0)
 
 	//if strings.Contains(ctx.host, "dallas5") {
 	//fmt.Println("[DEBUG] ForwardConnect() completed.", time.Since(start))
@@ -1164,7 +1186,7 @@ func (ctx *ProxyCtx) ForwardRequest(host string) error {
 		//if strings.Contains(ctx.host, "icanhazip") {
 		//	fmt.Println("[DEBUG] calling connectDialContext()", ctx.host)
 		//}
-		targetSiteConn, err = ctx.Proxy.connectDialContext(dnsbypassctx, "tcp", ctx.host)
+		targetSiteConn, err = ctx.Proxy.connectDialContext(ctx.proxyProtocolContext(dnsbypassctx), "tcp", ctx.host)
 		//d := HijackedDNSDialer()
 		//targetSiteConn, err = d.DialContext(dnsbypassctx, "tcp", ctx.host)
 		//fmt.Println("ForwardNonHTTPRequest() HTTP:", host, targetSiteConn)
@@ -1189,6 +1211,7 @@ func (ctx *ProxyCtx) ForwardRequest(host string) error {
 			return err
 		}
 	}
+	ctx.countForwarded()
 
 	//fmt.Printf("[DEBUG] Non-HTTP request to: %s  Conn: %+v\n", ctx.Host(), ctx.Conn)
 
@@ -1202,6 +1225,7 @@ func (ctx *ProxyCtx) ForwardRequest(host string) error {
 	//err = ctx.Req.Write(spyconnection)
 
 	//fmt.Printf("[DEBUG] The original request was...\n%s\n\n%Connection: %+v\n", ctx.NonHTTPRequest, targetSiteConn)
+	targetSiteConn = ctx.Proxy.Metrics.timeFirstByte(targetSiteConn)
 	_, err = fmt.Fprintf(targetSiteConn, string(ctx.NonHTTPRequest))
 	//err = ctx.Req.Write(targetSiteConn)
 
@@ -1210,9 +1234,7 @@ func (ctx *ProxyCtx) ForwardRequest(host string) error {
 		return err
 	}
 
-	fitter.Fit(ctx.Conn, targetSiteConn)
-	ctx.Conn.Close()
-	targetSiteConn.Close()
+	ctx.fuse(targetSiteConn, len(ctx.NonHTTPRequest))
 
 	return nil
 }
@@ -1291,6 +1313,7 @@ func (ctx *ProxyCtx) ForwardHTTPRequest(host string) error {
 		ctx.ResponseError = err
 		return err
 	}
+	ctx.countForwarded()
 
 	ctx.originalResponseBody = resp.Body
 	ctx.ResponseError = nil
@@ -1315,10 +1338,14 @@ func (ctx *ProxyCtx) DispatchResponseHandlers() error {
 	//fmt.Println("[DEBUG] DispatchResponseHandlers()")
 
 	var rejected = false
-	var then Next
-	for _, handler := range ctx.Proxy.responseHandlers {
+	for _, handler := range ctx.Proxy.responseHandlers.load() {
 		//fmt.Println("[DEBUG] DispatchResponseHandlers() Loop")
-		then = handler.Handle(ctx)
+		then, herr := ctx.callHandler("response", handler)
+		if herr != nil {
+			ctx.reportHandlerError(herr)
+			ctx.serveHandlerError(herr)
+			return herr
+		}
 		//fmt.Printf("[DEBUG] DispatchResponseHandlers: %s [URL: %s]\n", then, ctx.Req.URL.Host)
 		switch then {
 		case DONE:
@@ -1333,9 +1360,6 @@ func (ctx *ProxyCtx) DispatchResponseHandlers() error {
 		case FORWARD:
 			//fmt.Println("[DEBUG] DispatchResponseHandlers() FORWARD")
 			break
-		case MITM:
-			//fmt.Println("[DEBUG] DispatchResponseHandlers() MITM")
-			panic("MITM doesn't make sense when we are already parsing the request")
 		case REJECT:
 			//fmt.Println("[DEBUG] DispatchResponseHandlers() REJECT")
 			rejected = true
@@ -1346,7 +1370,11 @@ func (ctx *ProxyCtx) DispatchResponseHandlers() error {
 			//ctx.Logf(1, " *** DispatchResponseHandlers:SIGNATURE")
 		default:
 			//fmt.Println("[DEBUG] DispatchResponseHandlers() DEFAULT")
-			panic(fmt.Sprintf("Invalid value %v for Next after calling %v", then, handler))
+			// MITM doesn't make sense when we are already parsing the request
+			herr := ctx.invalidNext("response", handler, then)
+			ctx.reportHandlerError(herr)
+			ctx.serveHandlerError(herr)
+			return herr
 		}
 	}
 
@@ -1454,9 +1482,13 @@ func (ctx *ProxyCtx) DispatchResponseHandlers() error {
 }
 
 func (ctx *ProxyCtx) DispatchDoneHandlers() error {
-	var then Next
-	for _, handler := range ctx.Proxy.doneHandlers {
-		then = handler.Handle(ctx)
+	for _, handler := range ctx.Proxy.doneHandlers.load() {
+		then, herr := ctx.callHandler("done", handler)
+		if herr != nil {
+			// The response has already been sent, so there's nothing left to clean up.
+			ctx.reportHandlerError(herr)
+			return herr
+		}
 
 		switch then {
 		case DONE:
@@ -1465,10 +1497,11 @@ func (ctx *ProxyCtx) DispatchDoneHandlers() error {
 			continue
 		case FORWARD:
 			break
-		case MITM:
-			panic("MITM doesn't make sense when we are done")
-		case REJECT:
-			panic("REJECT a response ? then do what, send a 500 back ?")
+		case MITM, REJECT:
+			// MITM and REJECT don't make sense when we are done.
+			herr := ctx.invalidNext("done", handler, then)
+			ctx.reportHandlerError(herr)
+			return herr
 		case SIGNATURE:
 			//ctx.Logf(1, "  *** DispatchDoneHandlers:SIGNATURE")
 			return nil
@@ -1800,18 +1833,23 @@ func (ctx *ProxyCtx) httpError(parentErr error) {
 }
 
 // RLS 9/13/2017 - Alternate method to prevent memory leaks when connections are unexpectedly closed.
-func (ctx *ProxyCtx) copyAndClose(w, r net.Conn, toClose chan net.Conn) {
+// upload is set when r is the client connection, and selects the rate limits which apply.
+func (ctx *ProxyCtx) copyAndClose(w, r net.Conn, upload bool, toClose chan net.Conn) {
 	// Idle timeout - designed to close connections after 60 seconds of no activity
 	ridle := &IdleTimeoutConn{Conn: r}
 	widle := &IdleTimeoutConn{Conn: w}
 
+	// Throttle reads outside the idle timeout, so that waiting for the rate limit isn't mistaken
+	// for inactivity.
+	src := ctx.rateLimited(ridle, upload)
+
 	// This timeout is a sanity check simply designed to close connections after 5 minutes.
 	timeoutDuration := 300 * time.Second
 	ridle.SetReadDeadline(time.Now().Add(timeoutDuration))
 	widle.SetWriteDeadline(time.Now().Add(timeoutDuration))
 
 	//start := time.Now()
-	bytes, err := io.Copy(widle, ridle)
+	bytes, err := io.Copy(widle, src)
 	//fmt.Printf("[DEBUG] CopyAndClose - wrote %d bytes err=%+v\n", bytes,err)
 	if err != nil && bytes <= 0 {
 		ctx.Warnf("Error copying to client [%s]", ctx.Host(), err)
@@ -15,11 +15,17 @@ import (
 //
 // See `Next` values for the return value meaning
 func (proxy *ProxyHttpServer) HandleConnectFunc(f func(ctx *ProxyCtx) Next) {
-	proxy.connectHandlers = append(proxy.connectHandlers, HandlerFunc(f))
+	proxy.HandleConnect(HandlerFunc(f))
 }
 
 func (proxy *ProxyHttpServer) HandleConnect(f Handler) {
-	proxy.connectHandlers = append(proxy.connectHandlers, f)
+	proxy.connectHandlers.add(f, HandlerOptions{})
+}
+
+// HandleConnectNamed registers a CONNECT handler which can be removed at runtime, even while
+// connections are being dispatched. See HandlerOptions.
+func (proxy *ProxyHttpServer) HandleConnectNamed(opts HandlerOptions, f Handler) *HandlerRegistration {
+	return proxy.connectHandlers.add(f, opts)
 }
 
 // HandleRequestFunc and HandleRequest put hooks to handle certain
@@ -28,11 +34,16 @@ func (proxy *ProxyHttpServer) HandleConnect(f Handler) {
 //
 // See `Next` values for the return value meaning
 func (proxy *ProxyHttpServer) HandleRequestFunc(f func(ctx *ProxyCtx) Next) {
-	proxy.requestHandlers = append(proxy.requestHandlers, HandlerFunc(f))
+	proxy.HandleRequest(HandlerFunc(f))
 }
 
 func (proxy *ProxyHttpServer) HandleRequest(f Handler) {
-	proxy.requestHandlers = append(proxy.requestHandlers, f)
+	proxy.requestHandlers.add(f, HandlerOptions{})
+}
+
+// HandleRequestNamed registers a request handler which can be removed at runtime. See HandlerOptions.
+func (proxy *ProxyHttpServer) HandleRequestNamed(opts HandlerOptions, f Handler) *HandlerRegistration {
+	return proxy.requestHandlers.add(f, opts)
 }
 
 // HandleResponseFunc and HandleResponse put hooks to handle certain
@@ -41,11 +52,16 @@ func (proxy *ProxyHttpServer) HandleRequest(f Handler) {
 //
 // See `Next` values for the return value meaning
 func (proxy *ProxyHttpServer) HandleResponseFunc(f func(ctx *ProxyCtx) Next) {
-	proxy.responseHandlers = append(proxy.responseHandlers, HandlerFunc(f))
+	proxy.HandleResponse(HandlerFunc(f))
 }
 
 func (proxy *ProxyHttpServer) HandleResponse(f Handler) {
-	proxy.responseHandlers = append(proxy.responseHandlers, f)
+	proxy.responseHandlers.add(f, HandlerOptions{})
+}
+
+// HandleResponseNamed registers a response handler which can be removed at runtime. See HandlerOptions.
+func (proxy *ProxyHttpServer) HandleResponseNamed(opts HandlerOptions, f Handler) *HandlerRegistration {
+	return proxy.responseHandlers.add(f, opts)
 }
 
 // HandleDoneFunc and HandleDone are called at the end of every request.
@@ -53,11 +69,27 @@ func (proxy *ProxyHttpServer) HandleResponse(f Handler) {
 //
 // See `Next` values for the return value meaning
 func (proxy *ProxyHttpServer) HandleDoneFunc(f func(ctx *ProxyCtx) Next) {
-	proxy.doneHandlers = append(proxy.doneHandlers, HandlerFunc(f))
+	proxy.HandleDone(HandlerFunc(f))
 }
 
 func (proxy *ProxyHttpServer) HandleDone(f Handler) {
-	proxy.doneHandlers = append(proxy.doneHandlers, f)
+	proxy.doneHandlers.add(f, HandlerOptions{})
+}
+
+// HandleDoneNamed registers a done handler which can be removed at runtime. See HandlerOptions.
+func (proxy *ProxyHttpServer) HandleDoneNamed(opts HandlerOptions, f Handler) *HandlerRegistration {
+	return proxy.doneHandlers.add(f, opts)
+}
+
+// RemoveHandlerGroup removes every connect, request, response and done handler registered with
+// the given group, eg: to switch off a feature which installs several handlers. Returns the number
+// of handlers removed.
+func (proxy *ProxyHttpServer) RemoveHandlerGroup(group string) int {
+	inGroup := func(reg *HandlerRegistration) bool { return reg.Group == group }
+	return proxy.connectHandlers.remove(inGroup) +
+		proxy.requestHandlers.remove(inGroup) +
+		proxy.responseHandlers.remove(inGroup) +
+		proxy.doneHandlers.remove(inGroup)
 }
 
 //////
@@ -87,13 +119,17 @@ func (proxy *ProxyHttpServer) dispatchConnectHandlers(ctx *ProxyCtx) {
 
 	ctx.Conn = conn
 
-	var then Next
 
-	for _, handler := range proxy.connectHandlers {
+	for _, handler := range proxy.connectHandlers.load() {
 		//if trace {
 		//	fmt.Printf("[DEBUG] dispatchConnectHandlers() Loop [%s]\n", ctx.host)
 		//}
-		then = handler.Handle(ctx)
+		then, herr := ctx.callHandler("connect", handler)
+		if herr != nil {
+			ctx.reportHandlerError(herr)
+			ctx.httpError(herr)
+			return
+		}
 
 		switch then {
 		case NEXT:
@@ -122,6 +158,7 @@ func (proxy *ProxyHttpServer) dispatchConnectHandlers(ctx *ProxyCtx) {
 			if trace {
 				fmt.Printf("[DEBUG] dispatchConnectHandlers() - REJECT. [%s]\n", ctx.host)
 			}
+			ctx.countRequest(DecisionBlocked)
 			ctx.RejectConnect()
 
 			// What happens if we don't return anything?
@@ -134,7 +171,10 @@ func (proxy *ProxyHttpServer) dispatchConnectHandlers(ctx *ProxyCtx) {
 			}
 			return
 		default:
-			panic(fmt.Sprintf("Invalid value %v for Next after calling %v", then, handler))
+			herr := ctx.invalidNext("connect", handler, then)
+			ctx.reportHandlerError(herr)
+			ctx.httpError(herr)
+			return
 		}
 	}
 
@@ -154,9 +194,14 @@ func (proxy *ProxyHttpServer) dispatchConnectHandlers(ctx *ProxyCtx) {
 // RLS 5/22/2018 - exported so that we can use it for unit testing
 func (proxy *ProxyHttpServer) DispatchRequestHandlers(ctx *ProxyCtx) {
 	//fmt.Println("[DEBUG] Dispatcher.go:DispatchRequestHandlers()", ctx.host)
-	var then Next
-	for _, handler := range proxy.requestHandlers {
-		then = handler.Handle(ctx)
+	for _, handler := range proxy.requestHandlers.load() {
+		then, herr := ctx.callHandler("request", handler)
+		if herr != nil {
+			ctx.reportHandlerError(herr)
+			ctx.serveHandlerError(herr)
+			return
+		}
+
 		switch then {
 		case DONE:
 			ctx.DispatchDoneHandlers()
@@ -174,9 +219,8 @@ func (proxy *ProxyHttpServer) DispatchRequestHandlers(ctx *ProxyCtx) {
 				return
 			}
 			break
-		case MITM:
-			panic("MITM doesn't make sense when we are already parsing the request")
 		case REJECT:
+			ctx.countRequest(DecisionBlocked)
 			ext := filepath.Ext(ctx.Req.URL.Path)
 			//fmt.Printf("[DEBUG] DispatchRequestHandlers() - REJECT. [%s]\n", ctx.host)
 			switch ext {
@@ -209,7 +253,11 @@ func (proxy *ProxyHttpServer) DispatchRequestHandlers(ctx *ProxyCtx) {
 
 			return
 		default:
-			panic(fmt.Sprintf("Invalid value %v for Next after calling %v", then, handler))
+			// MITM doesn't make sense when we are already parsing the request
+			herr := ctx.invalidNext("request", handler, then)
+			ctx.reportHandlerError(herr)
+			ctx.serveHandlerError(herr)
+			return
 		}
 	}
 
@@ -1,11 +1,85 @@
 package goproxy
 
 import (
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
 )
 
+// Condition reports whether a request matches some criteria. Conditions can be combined with
+// And, Or and Not, and turned into handlers with When:
+//
+//  proxy.HandleRequest(When(And(CondRequestHostIsIn("example.com"), Not(CondIsLocalhost))).Do(handler))
+//
+// Each of the middlewares in this file is built from the Condition of the same name with a
+// `Cond` prefix.
+type Condition func(ctx *ProxyCtx) bool
+
+// And matches when all of the given conditions match. An empty And always matches.
+func And(conds ...Condition) Condition {
+	return func(ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if !cond(ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or matches when any of the given conditions match. An empty Or never matches.
+func Or(conds ...Condition) Condition {
+	return func(ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if cond(ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not inverts a condition.
+func Not(cond Condition) Condition {
+	return func(ctx *ProxyCtx) bool {
+		return !cond(ctx)
+	}
+}
+
+// Chain returns a middleware which only calls the chained handler when the condition matches.
+// Otherwise the request continues on to the NEXT handler.
+func (cond Condition) Chain() ChainedHandler {
+	return func(chainedHandler Handler) Handler {
+		return HandlerFunc(func(ctx *ProxyCtx) Next {
+			if cond(ctx) {
+				return chainedHandler.Handle(ctx)
+			}
+			return NEXT
+		})
+	}
+}
+
+// ConditionalHandler is returned by When. See Do and DoFunc.
+type ConditionalHandler struct {
+	cond Condition
+}
+
+// When starts building a handler which only runs when cond matches.
+func When(cond Condition) ConditionalHandler {
+	return ConditionalHandler{cond: cond}
+}
+
+// Do returns a handler which calls h when the condition matches and returns NEXT otherwise.
+func (w ConditionalHandler) Do(h Handler) Handler {
+	return w.cond.Chain()(h)
+}
+
+// DoFunc is a shortcut for Do(HandlerFunc(f)).
+func (w ConditionalHandler) DoFunc(f func(ctx *ProxyCtx) Next) Handler {
+	return w.Do(HandlerFunc(f))
+}
+
 // RespContentTypeIs is a middleware to filter apply a handler only to those requests matching a given content-type.
 //
 //  imageHandler := HandlerFunc(func(ctx *ProxyCtx) Next {
@@ -17,20 +91,24 @@ import (
 //  proxy.HandleRequest(RespContentTypeIs("image/jpeg", "image/gif")(imageHandler))
 //
 func RespContentTypeIs(types ...string) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			if ctx.Resp == nil {
-				return NEXT
-			}
+	return CondRespContentTypeIs(types...).Chain()
+}
+
+// CondRespContentTypeIs matches responses with one of the given content-types. It never matches
+// if there is no response yet.
+func CondRespContentTypeIs(types ...string) Condition {
+	return func(ctx *ProxyCtx) bool {
+		if ctx.Resp == nil {
+			return false
+		}
 
-			contentType := ctx.Resp.Header.Get("Content-Type")
-			for _, typ := range types {
-				if contentType == typ || strings.HasPrefix(contentType, typ+";") {
-					return chainedHandler.Handle(ctx)
-				}
+		contentType := ctx.Resp.Header.Get("Content-Type")
+		for _, typ := range types {
+			if contentType == typ || strings.HasPrefix(contentType, typ+";") {
+				return true
 			}
-			return NEXT
-		})
+		}
+		return false
 	}
 }
 
@@ -49,16 +127,16 @@ func RespContentTypeIs(types ...string) ChainedHandler {
 // For example UrlHasPrefix("host/x") will match requests of the form
 // 'GET host/x', and will match requests to url 'http://host/x'
 func UrlHasPrefix(prefix string) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			req := ctx.Req
-			if strings.HasPrefix(req.URL.Path, prefix) ||
-				strings.HasPrefix(req.URL.Host+"/"+req.URL.Path, prefix) ||
-				strings.HasPrefix(req.URL.Scheme+req.URL.Host+req.URL.Path, prefix) {
-				return chainedHandler.Handle(ctx)
-			}
-			return NEXT
-		})
+	return CondUrlHasPrefix(prefix).Chain()
+}
+
+// CondUrlHasPrefix is the Condition behind UrlHasPrefix.
+func CondUrlHasPrefix(prefix string) Condition {
+	return func(ctx *ProxyCtx) bool {
+		req := ctx.Req
+		return strings.HasPrefix(req.URL.Path, prefix) ||
+			strings.HasPrefix(req.URL.Host+"/"+req.URL.Path, prefix) ||
+			strings.HasPrefix(req.URL.Scheme+req.URL.Host+req.URL.Path, prefix)
 	}
 }
 
@@ -71,22 +149,21 @@ func UrlHasPrefix(prefix string) ChainedHandler {
 // * 'GET google.com/'
 // * 'GET /foo' for any host
 func UrlIsIn(urls ...string) ChainedHandler {
+	return CondUrlIsIn(urls...).Chain()
+}
+
+// CondUrlIsIn is the Condition behind UrlIsIn.
+func CondUrlIsIn(urls ...string) Condition {
 	urlSet := make(map[string]bool)
 	for _, u := range urls {
 		urlSet[u] = true
 	}
 
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			req := ctx.Req
-			_, pathOk := urlSet[req.URL.Path]
-			_, hostAndPathOk := urlSet[req.URL.Host+req.URL.Path]
-			if pathOk || hostAndPathOk {
-				return chainedHandler.Handle(ctx)
-			} else {
-				return NEXT
-			}
-		})
+	return func(ctx *ProxyCtx) bool {
+		req := ctx.Req
+		_, pathOk := urlSet[req.URL.Path]
+		_, hostAndPathOk := urlSet[req.URL.Host+req.URL.Path]
+		return pathOk || hostAndPathOk
 	}
 }
 
@@ -94,15 +171,18 @@ func UrlIsIn(urls ...string) ChainedHandler {
 // the request was directed to matches any of the given regular
 // expressions.
 func ReqHostMatches(regexps ...*regexp.Regexp) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			for _, re := range regexps {
-				if re.MatchString(ctx.Req.Host) {
-					return chainedHandler.Handle(ctx)
-				}
+	return CondReqHostMatches(regexps...).Chain()
+}
+
+// CondReqHostMatches is the Condition behind ReqHostMatches.
+func CondReqHostMatches(regexps ...*regexp.Regexp) Condition {
+	return func(ctx *ProxyCtx) bool {
+		for _, re := range regexps {
+			if re.MatchString(ctx.Req.Host) {
+				return true
 			}
-			return NEXT
-		})
+		}
+		return false
 	}
 }
 
@@ -110,15 +190,18 @@ func ReqHostMatches(regexps ...*regexp.Regexp) ChainedHandler {
 // the request is directed to contains one of the given strings.
 //
 func RequestHostContains(hosts ...string) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			for _, b := range hosts {
-				if strings.Contains(ctx.Req.URL.Host, b) {
-					return chainedHandler.Handle(ctx)
-				}
+	return CondRequestHostContains(hosts...).Chain()
+}
+
+// CondRequestHostContains is the Condition behind RequestHostContains.
+func CondRequestHostContains(hosts ...string) Condition {
+	return func(ctx *ProxyCtx) bool {
+		for _, b := range hosts {
+			if strings.Contains(ctx.Req.URL.Host, b) {
+				return true
 			}
-			return NEXT
-		})
+		}
+		return false
 	}
 }
 
@@ -127,28 +210,20 @@ func RequestHostContains(hosts ...string) ChainedHandler {
 //
 // This matcher supersedes and combines DstHostIs and ReqHostIs.
 func RequestHostIsIn(hosts ...string) ChainedHandler {
-	hostSet := HostsToMap(hosts...)
-
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			if MatchRequestHostMap(ctx.Req, hostSet) {
-				return chainedHandler.Handle(ctx)
-			}
-			return NEXT
-		})
-	}
+	return CondRequestHostIsIn(hosts...).Chain()
 }
 
+// RequestHostIsNotIn is the negation of RequestHostIsIn.
 func RequestHostIsNotIn(hosts ...string) ChainedHandler {
+	return Not(CondRequestHostIsIn(hosts...)).Chain()
+}
+
+// CondRequestHostIsIn is the Condition behind RequestHostIsIn.
+func CondRequestHostIsIn(hosts ...string) Condition {
 	hostSet := HostsToMap(hosts...)
 
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			if !MatchRequestHostMap(ctx.Req, hostSet) {
-				return chainedHandler.Handle(ctx)
-			}
-			return NEXT
-		})
+	return func(ctx *ProxyCtx) bool {
+		return MatchRequestHostMap(ctx.Req, hostSet)
 	}
 }
 
@@ -165,75 +240,86 @@ func MatchRequestHostMap(req *http.Request, hosts map[string]bool) bool {
 	return ok
 }
 
-var localHostIpv4 = regexp.MustCompile(`127\.0\.0\.\d+`)
-
 // IsLocalhost checks whether the destination host is explicitly local host
-// (buggy, there can be IPv6 addresses it doesn't catch)
 func IsLocalhost(chainedHandler Handler) Handler {
-	return HandlerFunc(func(ctx *ProxyCtx) Next {
-		if MatchIsLocalhost(ctx.Req) {
-			return chainedHandler.Handle(ctx)
-		}
-		return NEXT
-	})
+	return When(CondIsLocalhost).Do(chainedHandler)
 }
 
+// IsNotLocalhost is the negation of IsLocalhost.
 func IsNotLocalhost(chainedHandler Handler) Handler {
-	return HandlerFunc(func(ctx *ProxyCtx) Next {
-		if MatchIsLocalhost(ctx.Req) {
-			return chainedHandler.Handle(ctx)
-		}
-		return NEXT
-	})
+	return When(Not(CondIsLocalhost)).Do(chainedHandler)
 }
 
+// CondIsLocalhost is the Condition behind IsLocalhost.
+var CondIsLocalhost = Condition(func(ctx *ProxyCtx) bool {
+	return MatchIsLocalhost(ctx.Req)
+})
+
+// MatchIsLocalhost reports whether the request is addressed to "localhost" or to any IPv4 or
+// IPv6 loopback address, with or without a port.
 func MatchIsLocalhost(req *http.Request) bool {
-	return req.URL.Host == "::1" ||
-		req.URL.Host == "0:0:0:0:0:0:0:1" ||
-		localHostIpv4.MatchString(req.URL.Host) ||
-		req.URL.Host == "localhost"
+	host := strings.Trim(stripHostPort(req.URL.Host), "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return strings.EqualFold(host, "localhost")
 }
 
 // UrlMatches returns a ReqCondition testing whether the destination URL
 // of the request matches the given regexp, with or without prefix
 func UrlMatches(re *regexp.Regexp) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			req := ctx.Req
-			if re.MatchString(req.URL.Path) ||
-				re.MatchString(req.URL.Host+req.URL.Path) {
-				return chainedHandler.Handle(ctx)
-			}
-			return NEXT
-		})
+	return CondUrlMatches(re).Chain()
+}
+
+// CondUrlMatches is the Condition behind UrlMatches.
+func CondUrlMatches(re *regexp.Regexp) Condition {
+	return func(ctx *ProxyCtx) bool {
+		req := ctx.Req
+		return re.MatchString(req.URL.Path) ||
+			re.MatchString(req.URL.Host+req.URL.Path)
 	}
 }
 
 // MatchRemoteAddr returns a ReqCondtion testing wether the source IP of the request is the given string, Was renamed from `SrcIpIs`.
 func RemoteAddrIs(ip string) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			if CondRemoteAddrIs(ctx, ip) {
-				return chainedHandler.Handle(ctx)
-			}
-			return NEXT
-		})
-	}
+	return CondRemoteAddrIn(ip).Chain()
 }
 
+// RemoteAddrIsNot is the negation of RemoteAddrIs.
 func RemoteAddrIsNot(ip string) ChainedHandler {
-	return func(chainedHandler Handler) Handler {
-		return HandlerFunc(func(ctx *ProxyCtx) Next {
-			if !CondRemoteAddrIs(ctx, ip) {
-				return chainedHandler.Handle(ctx)
+	return Not(CondRemoteAddrIn(ip)).Chain()
+}
+
+// CondRemoteAddrIn matches requests whose source IP is one of the given IPs. IPv6 addresses
+// may be given with or without brackets.
+func CondRemoteAddrIn(ips ...string) Condition {
+	ipList := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if parsed := net.ParseIP(strings.Trim(ip, "[]")); parsed != nil {
+			ipList = append(ipList, parsed)
+		}
+	}
+
+	return func(ctx *ProxyCtx) bool {
+		host, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		remote := net.ParseIP(host)
+		if remote == nil {
+			return false
+		}
+		for _, ip := range ipList {
+			if ip.Equal(remote) {
+				return true
 			}
-			return NEXT
-		})
+		}
+		return false
 	}
 }
 
+// CondRemoteAddrIs reports whether the source IP of the request is ip. Predates Condition;
+// prefer CondRemoteAddrIn.
 func CondRemoteAddrIs(ctx *ProxyCtx, ip string) bool {
-	return strings.HasPrefix(ctx.Req.RemoteAddr, ip+":")
+	return CondRemoteAddrIn(ip)(ctx)
 }
-
-// TODO: implement the other "Not" conditions.
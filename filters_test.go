@@ -0,0 +1,73 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func requestCtx(host, remoteaddr string) *ProxyCtx {
+	return &ProxyCtx{Req: &http.Request{
+		URL:        &url.URL{Host: host, Path: "/"},
+		Host:       host,
+		RemoteAddr: remoteaddr,
+	}}
+}
+
+func TestConditions(t *testing.T) {
+	Convey("Conditions compose", t, func() {
+		yes := Condition(func(ctx *ProxyCtx) bool { return true })
+		no := Condition(func(ctx *ProxyCtx) bool { return false })
+		ctx := requestCtx("example.com", "10.0.0.1:5555")
+
+		So(And(yes, yes)(ctx), ShouldBeTrue)
+		So(And(yes, no)(ctx), ShouldBeFalse)
+		So(And()(ctx), ShouldBeTrue)
+		So(Or(no, yes)(ctx), ShouldBeTrue)
+		So(Or(no, no)(ctx), ShouldBeFalse)
+		So(Or()(ctx), ShouldBeFalse)
+		So(Not(yes)(ctx), ShouldBeFalse)
+		So(Not(And(yes, no))(ctx), ShouldBeTrue)
+	})
+
+	Convey("When().Do() only calls the handler if the condition matches", t, func() {
+		called := false
+		h := When(CondRequestHostIsIn("example.com")).DoFunc(func(ctx *ProxyCtx) Next {
+			called = true
+			return REJECT
+		})
+
+		So(h.Handle(requestCtx("example.org", "")), ShouldEqual, NEXT)
+		So(called, ShouldBeFalse)
+		So(h.Handle(requestCtx("example.com", "")), ShouldEqual, REJECT)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Negated filters are the inverse of the originals", t, func() {
+		reject := HandlerFunc(func(ctx *ProxyCtx) Next { return REJECT })
+		local := requestCtx("127.0.0.1", "10.0.0.1:5555")
+		remote := requestCtx("example.com", "10.0.0.2:5555")
+
+		So(IsLocalhost(reject).Handle(local), ShouldEqual, REJECT)
+		So(IsLocalhost(reject).Handle(remote), ShouldEqual, NEXT)
+		So(IsNotLocalhost(reject).Handle(local), ShouldEqual, NEXT)
+		So(IsNotLocalhost(reject).Handle(remote), ShouldEqual, REJECT)
+
+		So(RequestHostIsIn("example.com")(reject).Handle(remote), ShouldEqual, REJECT)
+		So(RequestHostIsNotIn("example.com")(reject).Handle(remote), ShouldEqual, NEXT)
+
+		So(RemoteAddrIs("10.0.0.1")(reject).Handle(local), ShouldEqual, REJECT)
+		So(RemoteAddrIsNot("10.0.0.1")(reject).Handle(local), ShouldEqual, NEXT)
+		So(RemoteAddrIsNot("10.0.0.1")(reject).Handle(remote), ShouldEqual, REJECT)
+	})
+
+	Convey("CondRemoteAddrIn matches IPv6 clients", t, func() {
+		So(CondRemoteAddrIn("10.0.0.1", "::1")(requestCtx("example.com", "[::1]:5555")), ShouldBeTrue)
+		So(CondRemoteAddrIs(requestCtx("example.com", "10.0.0.10:5555"), "10.0.0.1"), ShouldBeFalse)
+		So(CondRemoteAddrIs(requestCtx("example.com", "[::1]:5555"), "[::1]"), ShouldBeTrue)
+		So(CondRemoteAddrIs(requestCtx("example.com", "[::1]:5555"), "::1"), ShouldBeTrue)
+		So(CondRemoteAddrIs(requestCtx("example.com", "[::ffff:10.0.0.1]:5555"), "10.0.0.1"), ShouldBeTrue)
+	})
+}
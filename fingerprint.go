@@ -0,0 +1,164 @@
+package goproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/inconshreveable/go-vhost"
+)
+
+// JA3 returns the JA3 fingerprint of a ClientHello sniffed by vhost, and the JA3 string it is
+// the MD5 hash of. Both are empty if the ClientHello can't be parsed.
+func JA3(msg *vhost.ClientHelloMsg) (hash, full string) {
+	h := clientHelloFromVhost(msg)
+	if h == nil {
+		return "", ""
+	}
+	return h.JA3()
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello sniffed by vhost, or an empty string if it
+// can't be parsed.
+func JA4(msg *vhost.ClientHelloMsg) string {
+	h := clientHelloFromVhost(msg)
+	if h == nil {
+		return ""
+	}
+	return h.JA4()
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, which is the MD5 hash of the JA3 string
+// also returned.
+// Ref: https://github.com/salesforce/ja3
+func (h *ClientHello) JA3() (hash, full string) {
+	points := make([]uint16, len(h.points))
+	for i, p := range h.points {
+		points[i] = uint16(p)
+	}
+
+	full = strings.Join([]string{
+		strconv.Itoa(int(h.vers)),
+		ja3List(h.ciphers),
+		ja3List(h.extensions),
+		ja3List(h.curves),
+		ja3List(points),
+	}, ",")
+	sum := md5.Sum([]byte(full))
+	return hex.EncodeToString(sum[:]), full
+}
+
+// Joins the decimal values which aren't GREASE with dashes.
+func ja3List(values []uint16) string {
+	var b strings.Builder
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+	return b.String()
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, assuming it was received over TCP, such
+// as "t13d1516h2_8daaf6152771_e5627efa2ab1".
+// Ref: https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (h *ClientHello) JA4() string {
+	ciphers := h.CipherSuites()
+	extensions := h.Extensions()
+
+	sni := "i"
+	if h.HasExtension(extServerName) {
+		sni = "d"
+	}
+
+	// The hashed extensions are sorted, and leave out SNI and ALPN since they're already covered.
+	var hashed []uint16
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	sortUint16s(ciphers)
+	sortUint16s(hashed)
+
+	extString := ja4List(hashed)
+	if len(h.signatureAlgs) > 0 {
+		extString += "_" + ja4List(h.signatureAlgs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(h.MaxVersion()), sni, min99(len(ciphers)), min99(len(extensions)), ja4ALPN(h.alpn),
+		ja4Hash(ja4List(ciphers)), ja4Hash(extString))
+}
+
+func ja4Version(vers uint16) string {
+	switch vers {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// Returns the first and last characters of the first ALPN protocol, or of its hex encoding if
+// either isn't alphanumeric.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	proto := alpn[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(proto))
+		first, last = encoded[0], encoded[len(encoded)-1]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// Joins the values as 4 digit hex with commas.
+func ja4List(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Returns the first 12 hex digits of the SHA256 hash of s, or zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func sortUint16s(values []uint16) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/inconshreveable/go-vhost"
+)
+
+// Reads a ClientHello record captured from the wire, as ServeTLSListener would.
+func readClientHello(t *testing.T, name string) *vhost.ClientHelloMsg {
+	record, err := ioutil.ReadFile("test_data/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write(record)
+		client.Close()
+	}()
+	conn, err := vhost.TLS(server)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return conn.ClientHelloMsg
+}
+
+func TestFingerprints(t *testing.T) {
+	tests := []struct {
+		fixture string
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			// Built to match Chrome, with GREASE ciphers, extensions, groups and versions.
+			fixture: "clienthello_chrome_grease.bin",
+			ja3:     "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja3Hash: "cd08e31494f9531f560d64c695473da9",
+			ja4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			fixture: "clienthello_openssl.bin", // openssl s_client 3.0 with -alpn h2,http/1.1
+			ja3:     "771,4866-4867-4865-49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,0-11-10-35-16-22-23-13-43-45-51,29-23-30-25-24-256-257-258-259-260,0-1-2",
+			ja3Hash: "5a1edc7f170af1014fc65c994878e63c",
+			ja4:     "t13d3111h2_e8f1e7e78f70_1f22a2ca17c4",
+		},
+		{
+			fixture: "clienthello_curl.bin", // curl 7.88 with --http1.1
+			ja3:     "771,4866-4867-4865-49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,0-11-10-16-22-23-49-13-43-45-51-21,29-23-30-25-24-256-257-258-259-260,0-1-2",
+			ja3Hash: "0149f47eabf9a20d0893e2a44e5a6323",
+			ja4:     "t13d3112h1_e8f1e7e78f70_b26ce05bbdd6",
+		},
+		{
+			fixture: "clienthello_go.bin", // crypto/tls with h2 and http/1.1
+			ja3:     "771,49195-49199-49196-49200-52393-52392-49161-49171-49162-49172-4865-4866-4867,0-11-65281-23-18-5-10-13-50-16-43-51,4588-4587-4589-29-23-24-25,0",
+			ja3Hash: "03117a8ed39ef02427ebbc39f121275c",
+			ja4:     "t13d1312h2_f57a46bbacb6_f50d94e863eb",
+		},
+	}
+
+	for _, test := range tests {
+		hello := readClientHello(t, test.fixture)
+		hash, full := JA3(hello)
+		if full != test.ja3 {
+			t.Errorf("%s: JA3 string\n got %s\nwant %s", test.fixture, full, test.ja3)
+		}
+		if hash != test.ja3Hash {
+			t.Errorf("%s: JA3 = %s, want %s", test.fixture, hash, test.ja3Hash)
+		}
+		if ja4 := JA4(hello); ja4 != test.ja4 {
+			t.Errorf("%s: JA4 = %s, want %s", test.fixture, ja4, test.ja4)
+		}
+	}
+}
+
+func TestFingerprintsMalformed(t *testing.T) {
+	hello := readClientHello(t, "clienthello_go.bin")
+	truncated := *hello
+	truncated.Raw = hello.Raw[:len(hello.Raw)-3]
+
+	for _, h := range []*vhost.ClientHelloMsg{nil, {}, &truncated} {
+		if hash, full := JA3(h); hash != "" || full != "" {
+			t.Errorf("JA3 of malformed ClientHello = %q, %q", hash, full)
+		}
+		if ja4 := JA4(h); ja4 != "" {
+			t.Errorf("JA4 of malformed ClientHello = %q", ja4)
+		}
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := map[string]string{"": "00", "h2": "h2", "http/1.1": "h1", "h": "hh", "\xab": "ab", "x\x01": "71"}
+	for proto, want := range tests {
+		var alpn []string
+		if proto != "" {
+			alpn = []string{proto}
+		}
+		if got := ja4ALPN(alpn); got != want {
+			t.Errorf("ja4ALPN(%q) = %q, want %q", proto, got, want)
+		}
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("%#04x isn't GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x1301, 0x0000} {
+		if isGREASE(v) {
+			t.Errorf("%#04x is GREASE", v)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on what a FingerprintDB remembers in learning mode.
+const (
+	maxUnknownFingerprints = 10000
+	maxLearnedHosts        = 10
+)
+
+// FingerprintDB maps client fingerprints to device or application labels, such as "iPhone
+// Safari" or "Roku". A fingerprint may be a JA4 or JA3 fingerprint, a TLS CipherSignature or the
+// user agent signature produced by ConvertUserAgentToSignature. Set Proxy.Fingerprints to label
+// each request's ctx.DeviceLabel before the connect handlers run.
+//
+// The database can be loaded from a JSON file holding an array of
+// {"fingerprint": "...", "label": "..."} objects, or from a CSV file of fingerprint,label rows.
+// Blank lines and lines beginning with # are ignored in CSV files.
+//
+// In learning mode, fingerprints which aren't in the database are recorded along with the first
+// hosts they connected to, to help identify them. See Unknown().
+type FingerprintDB struct {
+	mu       sync.RWMutex
+	path     string
+	modTime  time.Time
+	labels   map[string]string
+	learning bool
+	unknown  map[string]*UnknownFingerprint
+}
+
+// UnknownFingerprint describes a client which a FingerprintDB didn't recognize while it was
+// learning.
+type UnknownFingerprint struct {
+	Fingerprint string // The key recorded: the JA4 fingerprint if known, else JA3, else CipherSignature
+	JA3         string `json:",omitempty"`
+	JA4         string `json:",omitempty"`
+	Signature   string `json:",omitempty"`
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Count       int
+	Hosts       []string // The first hosts the client connected to, up to 10
+}
+
+type fingerprintEntry struct {
+	Fingerprint string `json:"fingerprint"`
+	Label       string `json:"label"`
+}
+
+// NewFingerprintDB returns an empty database.
+func NewFingerprintDB() *FingerprintDB {
+	return &FingerprintDB{
+		labels:  make(map[string]string),
+		unknown: make(map[string]*UnknownFingerprint),
+	}
+}
+
+// LoadFingerprintDB reads a database from a .json or .csv file. Call Reload() or Watch() to pick
+// up later changes to the file.
+func LoadFingerprintDB(path string) (*FingerprintDB, error) {
+	db := NewFingerprintDB()
+	db.path = path
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload re-reads the file the database was loaded from, replacing all of its labels, including
+// those added with Add(). If the file can't be read or parsed, the current labels are kept.
+func (db *FingerprintDB) Reload() error {
+	db.mu.RLock()
+	path := db.path
+	db.mu.RUnlock()
+	if path == "" {
+		return fmt.Errorf("fingerprint database wasn't loaded from a file")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	labels, err := parseFingerprints(path, data)
+	if err != nil {
+		return fmt.Errorf("error parsing fingerprint database %s: %v", path, err)
+	}
+
+	db.mu.Lock()
+	db.labels = labels
+	db.modTime = info.ModTime()
+	for fingerprint := range labels {
+		delete(db.unknown, fingerprint)
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the database whenever the file it was loaded from changes, checking every
+// interval. Errors are passed to onError, which may be nil. Call the returned function to stop
+// watching.
+func (db *FingerprintDB) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if err := db.reloadIfModified(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (db *FingerprintDB) reloadIfModified() error {
+	db.mu.RLock()
+	path, modTime := db.path, db.modTime
+	db.mu.RUnlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+	return db.Reload()
+}
+
+// Parses a database file, choosing the format from its extension or, failing that, its content.
+func parseFingerprints(path string, data []byte) (map[string]string, error) {
+	var entries []fingerprintEntry
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case ext == ".json" || ext != ".csv" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")):
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+	default:
+		r := csv.NewReader(bytes.NewReader(data))
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) < 2 {
+				return nil, fmt.Errorf("expected fingerprint,label but got %q", strings.Join(record, ","))
+			}
+			if len(entries) == 0 && strings.EqualFold(record[0], "fingerprint") {
+				continue // Header
+			}
+			entries = append(entries, fingerprintEntry{Fingerprint: record[0], Label: record[1]})
+		}
+	}
+
+	labels := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		fingerprint := normalizeFingerprint(entry.Fingerprint)
+		if fingerprint != "" && entry.Label != "" {
+			labels[fingerprint] = strings.TrimSpace(entry.Label)
+		}
+	}
+	return labels, nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.TrimSpace(fingerprint))
+}
+
+// Add labels a fingerprint. The label is lost if the database is reloaded from its file.
+func (db *FingerprintDB) Add(fingerprint, label string) {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint == "" {
+		return
+	}
+
+	db.mu.Lock()
+	db.labels[fingerprint] = label
+	delete(db.unknown, fingerprint)
+	db.mu.Unlock()
+}
+
+// Lookup returns the label of the first of the fingerprints which is in the database.
+func (db *FingerprintDB) Lookup(fingerprints ...string) (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, fingerprint := range fingerprints {
+		if label, ok := db.labels[normalizeFingerprint(fingerprint)]; ok {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of labelled fingerprints.
+func (db *FingerprintDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.labels)
+}
+
+// SetLearning turns learning mode on or off. Turning it off forgets the unknown fingerprints.
+func (db *FingerprintDB) SetLearning(learning bool) {
+	db.mu.Lock()
+	db.learning = learning
+	if !learning {
+		db.unknown = make(map[string]*UnknownFingerprint)
+	}
+	db.mu.Unlock()
+}
+
+// Unknown returns the unrecognized fingerprints seen in learning mode, most frequent first.
+func (db *FingerprintDB) Unknown() []UnknownFingerprint {
+	db.mu.RLock()
+	unknown := make([]UnknownFingerprint, 0, len(db.unknown))
+	for _, u := range db.unknown {
+		c := *u
+		c.Hosts = append([]string(nil), u.Hosts...)
+		unknown = append(unknown, c)
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(unknown, func(i, j int) bool {
+		if unknown[i].Count != unknown[j].Count {
+			return unknown[i].Count > unknown[j].Count
+		}
+		return unknown[i].Fingerprint < unknown[j].Fingerprint
+	})
+	return unknown
+}
+
+// Records a client which wasn't found in the database, if learning.
+func (db *FingerprintDB) learn(ja3, ja4, signature, host string) {
+	fingerprint := normalizeFingerprint(ja4)
+	if fingerprint == "" {
+		fingerprint = normalizeFingerprint(ja3)
+	}
+	if fingerprint == "" && signature != "unknown" {
+		fingerprint = normalizeFingerprint(signature)
+	}
+	if fingerprint == "" {
+		return
+	}
+
+	now := time.Now()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.learning {
+		return
+	}
+
+	u, ok := db.unknown[fingerprint]
+	if !ok {
+		if len(db.unknown) >= maxUnknownFingerprints {
+			return
+		}
+		u = &UnknownFingerprint{Fingerprint: fingerprint, JA3: ja3, JA4: ja4, Signature: signature, FirstSeen: now}
+		db.unknown[fingerprint] = u
+	}
+	u.LastSeen = now
+	u.Count++
+
+	if host == "" || len(u.Hosts) >= maxLearnedHosts {
+		return
+	}
+	for _, h := range u.Hosts {
+		if h == host {
+			return
+		}
+	}
+	u.Hosts = append(u.Hosts, host)
+}
+
+// Sets ctx.DeviceLabel from the proxy's fingerprint database, preferring the most specific
+// fingerprint the client presented. Unknown clients are recorded if the database is learning.
+func (proxy *ProxyHttpServer) classifyDevice(ctx *ProxyCtx) {
+	db := proxy.Fingerprints
+	if db == nil {
+		return
+	}
+
+	if label, ok := db.Lookup(ctx.JA4, ctx.JA3, ctx.CipherSignature); ok {
+		ctx.DeviceLabel = label
+		return
+	}
+	db.learn(ctx.JA3, ctx.JA4, ctx.CipherSignature, stripHostPort(ctx.host))
+}
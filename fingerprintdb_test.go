@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFingerprintFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFingerprintDBFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fingerprints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"db.json": `[{"fingerprint": "T13D1516H2_8daaf6152771_e5627efa2ab1", "label": "Chrome"},
+			{"fingerprint": "macos-desktop-safari", "label": "Safari"}]`,
+		"db.csv": "fingerprint,label\n# Browsers\nt13d1516h2_8daaf6152771_e5627efa2ab1, Chrome\n\nmacos-desktop-safari,Safari\n",
+		"db.txt": `[{"fingerprint": "t13d1516h2_8daaf6152771_e5627efa2ab1", "label": "Chrome"}, {"fingerprint": "macos-desktop-safari", "label": "Safari"}]`,
+	}
+	for name, content := range files {
+		db, err := LoadFingerprintDB(writeFingerprintFile(t, dir, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if db.Len() != 2 {
+			t.Errorf("%s: loaded %d fingerprints, want 2", name, db.Len())
+		}
+		if label, _ := db.Lookup("", "t13d1516h2_8daaf6152771_e5627efa2ab1"); label != "Chrome" {
+			t.Errorf("%s: got label %q, want Chrome", name, label)
+		}
+		if _, ok := db.Lookup("unknown"); ok {
+			t.Errorf("%s: found a fingerprint which isn't in the file", name)
+		}
+	}
+
+	if _, err := LoadFingerprintDB(writeFingerprintFile(t, dir, "bad.csv", "only-a-fingerprint\n")); err == nil {
+		t.Errorf("loaded a CSV row without a label")
+	}
+}
+
+func TestFingerprintDBWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fingerprints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFingerprintFile(t, dir, "db.csv", "aaa,Roku\n")
+	db, err := LoadFingerprintDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := db.Watch(10*time.Millisecond, nil)
+	defer stop()
+
+	// Make sure the modification time changes even on filesystems with coarse timestamps.
+	writeFingerprintFile(t, dir, "db.csv", "bbb,Echo\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if label, _ := db.Lookup("bbb"); label == "Echo" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("database wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := db.Lookup("aaa"); ok {
+		t.Errorf("reloaded database kept a removed fingerprint")
+	}
+
+	// A broken file leaves the current labels in place.
+	writeFingerprintFile(t, dir, "db.csv", "bbb\n")
+	if err := db.Reload(); err == nil {
+		t.Errorf("reloaded a broken file")
+	}
+	if label, _ := db.Lookup("bbb"); label != "Echo" {
+		t.Errorf("broken file replaced the labels")
+	}
+}
+
+func TestClassifyDevice(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.Fingerprints = NewFingerprintDB()
+	proxy.Fingerprints.Add("sig-tv", "Smart TV")
+	proxy.Fingerprints.Add("ja3-phone", "Phone")
+	proxy.Fingerprints.SetLearning(true)
+
+	ctx := &ProxyCtx{Proxy: proxy, JA3: "ja3-phone", CipherSignature: "sig-tv", host: "example.com:443"}
+	proxy.classifyDevice(ctx)
+	if ctx.DeviceLabel != "Phone" {
+		t.Errorf("got label %q, want the JA3 match", ctx.DeviceLabel)
+	}
+
+	for i, host := range []string{"a.example.com:443", "b.example.com:443", "a.example.com:443"} {
+		ctx := &ProxyCtx{Proxy: proxy, JA3: "ja3-new", JA4: "ja4-new", CipherSignature: "sig-new", host: host}
+		proxy.classifyDevice(ctx)
+		if ctx.DeviceLabel != "" {
+			t.Errorf("request %d labelled %q", i, ctx.DeviceLabel)
+		}
+	}
+	unknown := proxy.Fingerprints.Unknown()
+	if len(unknown) != 1 {
+		t.Fatalf("got %d unknown fingerprints, want 1", len(unknown))
+	}
+	u := unknown[0]
+	if u.Fingerprint != "ja4-new" || u.JA3 != "ja3-new" || u.Count != 3 {
+		t.Errorf("unexpected unknown fingerprint %+v", u)
+	}
+	if len(u.Hosts) != 2 || u.Hosts[0] != "a.example.com" || u.Hosts[1] != "b.example.com" {
+		t.Errorf("got hosts %v", u.Hosts)
+	}
+
+	// Labelling the fingerprint removes it from the unknown list.
+	proxy.Fingerprints.Add("ja4-new", "Laptop")
+	if len(proxy.Fingerprints.Unknown()) != 0 {
+		t.Errorf("labelled fingerprint is still unknown")
+	}
+}
@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// HandlerError describes a handler which panicked, or which returned a Next value that isn't
+// valid where it was called. The dispatcher recovers, closes the client connection (serving an
+// error page when it can) and passes the error to ProxyHttpServer.OnHandlerError.
+type HandlerError struct {
+	Handler string      // HandlerOptions.Name, or the name of the handler's function or type
+	Stage   string      // "connect", "request", "response" or "done"
+	Host    string      // Destination host of the request
+	Panic   interface{} // Value the handler panicked with. Nil if it returned an invalid Next.
+	Next    Next        // Value returned by the handler if it didn't panic
+	Stack   []byte      // Stack trace of the panic
+}
+
+func (e *HandlerError) Error() string {
+	if e.Panic != nil {
+		return fmt.Sprintf("%s handler %s panicked on %s: %v", e.Stage, e.Handler, e.Host, e.Panic)
+	}
+	return fmt.Sprintf("%s handler %s returned invalid value %v on %s", e.Stage, e.Handler, e.Next, e.Host)
+}
+
+// Returns a printable name for a registered handler.
+func (reg *HandlerRegistration) name() string {
+	if reg.Name != "" {
+		return reg.Name
+	}
+	if f, ok := reg.handler.(HandlerFunc); ok {
+		if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+	return fmt.Sprintf("%T", reg.handler)
+}
+
+// Calls a handler, recovering from any panic, and records its latency and result. herr is
+// non-nil if the handler panicked.
+func (ctx *ProxyCtx) callHandler(stage string, reg *HandlerRegistration) (then Next, herr *HandlerError) {
+	start := time.Now()
+	defer func() {
+		r := recover()
+		reg.stats.record(then, time.Since(start), r != nil)
+		if r != nil {
+			herr = &HandlerError{
+				Handler: reg.name(),
+				Stage:   stage,
+				Host:    ctx.host,
+				Panic:   r,
+				Stack:   debug.Stack(),
+			}
+		}
+	}()
+	return reg.Handle(ctx), nil
+}
+
+// Returns the error for a handler which returned a Next value that isn't valid for the stage.
+func (ctx *ProxyCtx) invalidNext(stage string, reg *HandlerRegistration, then Next) *HandlerError {
+	return &HandlerError{Handler: reg.name(), Stage: stage, Host: ctx.host, Next: then}
+}
+
+// Logs a handler error and passes it on to OnHandlerError. These are always logged, regardless
+// of the verbosity level.
+func (ctx *ProxyCtx) reportHandlerError(herr *HandlerError) {
+	ctx.Error = herr
+	if ctx.Proxy.Logger != nil {
+		if herr.Stack != nil {
+			ctx.Proxy.Logger.Printf("[ERROR] %s\n%s", herr, herr.Stack)
+		} else {
+			ctx.Proxy.Logger.Printf("[ERROR] %s", herr)
+		}
+	}
+
+	if ctx.Proxy.OnHandlerError != nil {
+		ctx.Proxy.OnHandlerError(ctx, herr)
+	}
+}
+
+// Sends an error page to an HTTP client after a request or response handler failed, then closes
+// the connection since we can't tell what state the handler left the request in. Any upstream
+// response is discarded.
+func (ctx *ProxyCtx) serveHandlerError(herr *HandlerError) {
+	if ctx.Resp != nil && ctx.Resp.Body != nil {
+		ctx.Resp.Body.Close()
+	}
+
+	if ctx.Req != nil && ctx.ResponseWriter != nil {
+		body := strings.Replace(blockedhtml, "%BLOCKED%", "502 Bad Gateway", 1)
+		body = strings.Replace(body, "%TITLE%", "Internal error", 1)
+		body = strings.Replace(body, "%TEXT%", "An internal error occurred while processing this request. It may resolve itself by refreshing the page.", 1)
+		body = strings.Replace(body, "%PROCEED%", "", 1)
+		ctx.NewResponse(502, "text/html; charset=utf-8", body)
+		if err := ctx.ForwardResponse(ctx.Resp); err != nil {
+			ctx.Warnf("Error sending error page to client: %s", err)
+		}
+	}
+
+	if ctx.Conn != nil {
+		ctx.Conn.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Response body which records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestResponseHandlerPanicClosesUpstreamBody(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.HandleResponseFunc(func(ctx *ProxyCtx) Next { panic("boom") })
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	upstream := &closeRecorder{Reader: strings.NewReader("upstream")}
+	w := httptest.NewRecorder()
+	ctx := &ProxyCtx{
+		Proxy:          proxy,
+		Req:            req,
+		Resp:           &http.Response{StatusCode: 200, Header: make(http.Header), Body: upstream},
+		ResponseWriter: w,
+	}
+
+	if err := ctx.DispatchResponseHandlers(); err == nil {
+		t.Fatal("expected the handler error to be returned")
+	}
+	if !upstream.closed {
+		t.Error("upstream response body was not closed")
+	}
+	if w.Code != 502 {
+		t.Errorf("got status %d, want 502", w.Code)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), "Internal error") {
+		t.Errorf("unexpected error page: %s", body)
+	}
+}
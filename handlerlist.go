@@ -0,0 +1,97 @@
+package goproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// HandlerOptions describes a handler registered with one of the HandleXxxNamed functions.
+type HandlerOptions struct {
+	// Identifies the handler in logs. Need not be unique.
+	Name string
+
+	// Handlers sharing a group can be removed together with RemoveHandlerGroup().
+	Group string
+
+	// Handlers run in ascending order of priority, and in the order they were registered when
+	// priorities are equal. Handlers registered through HandleConnect(), HandleRequest() etc. have
+	// priority 0.
+	Priority int
+}
+
+// HandlerRegistration is returned when a handler is registered so that it can be removed again.
+type HandlerRegistration struct {
+	HandlerOptions
+	handler Handler
+	list    *handlerList
+	seq     uint64
+	stats   *handlerStats
+}
+
+// Remove unregisters the handler. Requests which are already being dispatched may still call it
+// once. Returns false if the handler had already been removed.
+func (reg *HandlerRegistration) Remove() bool {
+	return reg.list.remove(func(r *HandlerRegistration) bool { return r == reg }) > 0
+}
+
+// Handle calls the registered handler.
+func (reg *HandlerRegistration) Handle(ctx *ProxyCtx) Next {
+	return reg.handler.Handle(ctx)
+}
+
+// A list of handlers which can be modified while requests are being dispatched. Writers replace
+// the whole (sorted) slice, so readers can iterate over a snapshot without locking.
+type handlerList struct {
+	mu       sync.Mutex   // Serializes writers
+	handlers atomic.Value // []*HandlerRegistration, never modified once stored
+	seq      uint64
+}
+
+// Returns a snapshot of the registered handlers in the order they should run.
+func (l *handlerList) load() []*HandlerRegistration {
+	handlers, _ := l.handlers.Load().([]*HandlerRegistration)
+	return handlers
+}
+
+func (l *handlerList) add(h Handler, opts HandlerOptions) *HandlerRegistration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	reg := &HandlerRegistration{HandlerOptions: opts, handler: h, list: l, seq: l.seq, stats: &handlerStats{}}
+
+	old := l.load()
+	handlers := make([]*HandlerRegistration, len(old), len(old)+1)
+	copy(handlers, old)
+	handlers = append(handlers, reg)
+	sort.SliceStable(handlers, func(i, j int) bool {
+		if handlers[i].Priority != handlers[j].Priority {
+			return handlers[i].Priority < handlers[j].Priority
+		}
+		return handlers[i].seq < handlers[j].seq
+	})
+
+	l.handlers.Store(handlers)
+	return reg
+}
+
+// Removes all handlers for which match returns true. Returns the number of handlers removed.
+func (l *handlerList) remove(match func(*HandlerRegistration) bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old := l.load()
+	handlers := make([]*HandlerRegistration, 0, len(old))
+	for _, reg := range old {
+		if !match(reg) {
+			handlers = append(handlers, reg)
+		}
+	}
+
+	if removed := len(old) - len(handlers); removed > 0 {
+		l.handlers.Store(handlers)
+		return removed
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"sync"
+	"testing"
+)
+
+func handlerNames(l *handlerList) []string {
+	var names []string
+	for _, reg := range l.load() {
+		names = append(names, reg.Name)
+	}
+	return names
+}
+
+func TestHandlerRegistration(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	next := HandlerFunc(func(ctx *ProxyCtx) Next { return NEXT })
+
+	proxy.HandleRequestNamed(HandlerOptions{Name: "b", Priority: 10}, next)
+	a := proxy.HandleRequestNamed(HandlerOptions{Name: "a", Priority: -5, Group: "parental"}, next)
+	proxy.HandleRequestNamed(HandlerOptions{Name: "c", Priority: 10, Group: "parental"}, next)
+	proxy.HandleRequest(next)
+	proxy.HandleConnectNamed(HandlerOptions{Name: "connect", Group: "parental"}, next)
+
+	if got := handlerNames(&proxy.requestHandlers); len(got) != 4 || got[0] != "a" || got[1] != "" || got[2] != "b" || got[3] != "c" {
+		t.Fatalf("handlers are out of order: %q", got)
+	}
+
+	if !a.Remove() {
+		t.Error("Remove() returned false for a registered handler")
+	}
+	if a.Remove() {
+		t.Error("Remove() returned true for a handler which was already removed")
+	}
+	if got := handlerNames(&proxy.requestHandlers); len(got) != 3 || got[0] != "" {
+		t.Errorf("handler wasn't removed: %q", got)
+	}
+
+	if n := proxy.RemoveHandlerGroup("parental"); n != 2 {
+		t.Errorf("RemoveHandlerGroup() removed %d handlers, want 2", n)
+	}
+	if got := handlerNames(&proxy.requestHandlers); len(got) != 2 || got[0] != "" || got[1] != "b" {
+		t.Errorf("group wasn't removed: %q", got)
+	}
+	if len(proxy.connectHandlers.load()) != 0 {
+		t.Error("connect handler in group wasn't removed")
+	}
+}
+
+// Run with -race to check that dispatching doesn't race with reconfiguration.
+func TestHandlerRegistrationConcurrent(t *testing.T) {
+	proxy := NewProxyHttpServer()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx := &ProxyCtx{Proxy: proxy}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				ctx.DispatchDoneHandlers()
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		reg := proxy.HandleDoneNamed(HandlerOptions{Name: "toggle"}, HandlerFunc(func(ctx *ProxyCtx) Next { return NEXT }))
+		reg.Remove()
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,158 @@
+package goproxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var nextNames = [...]string{
+	NEXT:      "NEXT",
+	MOCK:      "MOCK",
+	DONE:      "DONE",
+	FORWARD:   "FORWARD",
+	MITM:      "MITM",
+	REJECT:    "REJECT",
+	SIGNATURE: "SIGNATURE",
+}
+
+func (n Next) String() string {
+	if n >= 0 && int(n) < len(nextNames) {
+		return nextNames[n]
+	}
+	return fmt.Sprintf("Next(%d)", int(n))
+}
+
+// Handler latencies are counted in exponential buckets. Bucket i holds calls which took less
+// than handlerLatencyBase << i, and the last bucket holds everything slower.
+const (
+	handlerLatencyBase    = time.Microsecond
+	handlerLatencyBuckets = 24 // 1µs to ~8s
+)
+
+// Counters for a single registered handler. Updated atomically by the dispatcher, so the
+// uint64 fields must stay at the start of the struct for 32-bit platforms.
+type handlerStats struct {
+	calls   uint64
+	panics  uint64
+	nanos   uint64
+	latency [handlerLatencyBuckets + 1]uint64
+	results [len(nextNames) + 1]uint64 // The last slot counts invalid Next values.
+}
+
+func (s *handlerStats) record(then Next, elapsed time.Duration, panicked bool) {
+	atomic.AddUint64(&s.calls, 1)
+	atomic.AddUint64(&s.nanos, uint64(elapsed))
+
+	bucket := 0
+	for bucket < handlerLatencyBuckets && elapsed >= handlerLatencyBase<<uint(bucket) {
+		bucket++
+	}
+	atomic.AddUint64(&s.latency[bucket], 1)
+
+	if panicked {
+		atomic.AddUint64(&s.panics, 1)
+		return
+	}
+	if then >= 0 && int(then) < len(nextNames) {
+		atomic.AddUint64(&s.results[then], 1)
+	} else {
+		atomic.AddUint64(&s.results[len(nextNames)], 1)
+	}
+}
+
+// LatencyBucket is one bucket of a handler latency histogram.
+type LatencyBucket struct {
+	UpperBound time.Duration // Zero for the last bucket, which has no upper bound
+	Count      uint64        // Calls which took less than UpperBound. Cumulative.
+}
+
+// HandlerStats is a snapshot of the calls made to a registered handler since it was registered.
+type HandlerStats struct {
+	HandlerOptions
+	Handler string // Name, or the name of the handler's function or type if it has none
+	Stage   string // "connect", "request", "response" or "done"
+
+	Calls   uint64
+	Panics  uint64
+	Invalid uint64          // Calls which returned a Next value that isn't defined
+	Results map[Next]uint64 // Number of times each Next value was returned
+
+	Total   time.Duration   // Time spent in the handler across all calls
+	P99     time.Duration   // Upper bound of the bucket holding the 99th percentile call
+	Latency []LatencyBucket // Cumulative histogram
+}
+
+// Mean returns the average time spent per call.
+func (s HandlerStats) Mean() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+func (reg *HandlerRegistration) snapshot(stage string) HandlerStats {
+	s := reg.stats
+	stats := HandlerStats{
+		HandlerOptions: reg.HandlerOptions,
+		Handler:        reg.name(),
+		Stage:          stage,
+		Calls:          atomic.LoadUint64(&s.calls),
+		Panics:         atomic.LoadUint64(&s.panics),
+		Invalid:        atomic.LoadUint64(&s.results[len(nextNames)]),
+		Results:        make(map[Next]uint64),
+		Total:          time.Duration(atomic.LoadUint64(&s.nanos)),
+		Latency:        make([]LatencyBucket, handlerLatencyBuckets+1),
+	}
+
+	for i := range nextNames {
+		if n := atomic.LoadUint64(&s.results[i]); n > 0 {
+			stats.Results[Next(i)] = n
+		}
+	}
+
+	var count uint64
+	for i := range stats.Latency {
+		count += atomic.LoadUint64(&s.latency[i])
+		stats.Latency[i].Count = count
+		if i < handlerLatencyBuckets {
+			stats.Latency[i].UpperBound = handlerLatencyBase << uint(i)
+		}
+	}
+
+	// The buckets were loaded one by one, so use their total rather than Calls.
+	if count > 0 {
+		threshold := count - count/100
+		for _, b := range stats.Latency {
+			if b.Count >= threshold {
+				stats.P99 = b.UpperBound
+				break
+			}
+		}
+		if stats.P99 == 0 {
+			// The slowest calls fell in the unbounded bucket.
+			stats.P99 = handlerLatencyBase << uint(handlerLatencyBuckets-1)
+		}
+	}
+	return stats
+}
+
+// HandlerStats returns the call counts and latencies of every registered handler, in the order
+// they run for each stage. Stats are kept for as long as a handler is registered.
+func (proxy *ProxyHttpServer) HandlerStats() []HandlerStats {
+	var stats []HandlerStats
+	for _, l := range []struct {
+		stage string
+		list  *handlerList
+	}{
+		{"connect", &proxy.connectHandlers},
+		{"request", &proxy.requestHandlers},
+		{"response", &proxy.responseHandlers},
+		{"done", &proxy.doneHandlers},
+	} {
+		for _, reg := range l.list.load() {
+			stats = append(stats, reg.snapshot(l.stage))
+		}
+	}
+	return stats
+}
@@ -0,0 +1,73 @@
+package goproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerStats(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	calls := 0
+	proxy.HandleDoneNamed(HandlerOptions{Name: "slow", Group: "test"}, HandlerFunc(func(ctx *ProxyCtx) Next {
+		calls++
+		if calls == 100 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if calls%2 == 0 {
+			return FORWARD
+		}
+		return NEXT
+	}))
+	proxy.HandleDoneFunc(func(ctx *ProxyCtx) Next { return DONE })
+
+	ctx := &ProxyCtx{Proxy: proxy}
+	for i := 0; i < 200; i++ {
+		ctx.DispatchDoneHandlers()
+	}
+
+	stats := proxy.HandlerStats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats for %d handlers, want 2", len(stats))
+	}
+
+	slow := stats[0]
+	if slow.Handler != "slow" || slow.Group != "test" || slow.Stage != "done" {
+		t.Errorf("unexpected handler %q in group %q at stage %q", slow.Handler, slow.Group, slow.Stage)
+	}
+	if slow.Calls != 200 || slow.Results[NEXT] != 100 || slow.Results[FORWARD] != 100 {
+		t.Errorf("unexpected counts: %d calls, results %v", slow.Calls, slow.Results)
+	}
+	if slow.Total < 20*time.Millisecond {
+		t.Errorf("total time %s doesn't include the slow call", slow.Total)
+	}
+	// A single slow call out of 200 is above the 99th percentile.
+	if slow.P99 >= 20*time.Millisecond {
+		t.Errorf("p99 is %s, expected the slow call to be excluded", slow.P99)
+	}
+	if last := slow.Latency[len(slow.Latency)-1]; last.Count != 200 || last.UpperBound != 0 {
+		t.Errorf("unexpected last bucket %+v", last)
+	}
+
+	if stats[1].Calls != 200 || stats[1].Results[DONE] != 200 {
+		t.Errorf("unexpected counts for second handler: %d calls, results %v", stats[1].Calls, stats[1].Results)
+	}
+}
+
+func TestHandlerStatsPanics(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.HandleDoneFunc(func(ctx *ProxyCtx) Next { panic("boom") })
+
+	ctx := &ProxyCtx{Proxy: proxy}
+	ctx.DispatchDoneHandlers()
+
+	stats := proxy.HandlerStats()
+	if stats[0].Calls != 1 || stats[0].Panics != 1 || len(stats[0].Results) != 0 {
+		t.Errorf("unexpected stats for panicking handler: %+v", stats[0])
+	}
+}
+
+func TestNextString(t *testing.T) {
+	if REJECT.String() != "REJECT" || Next(99).String() != "Next(99)" {
+		t.Errorf("unexpected names %s, %s", REJECT, Next(99))
+	}
+}
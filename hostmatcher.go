@@ -0,0 +1,143 @@
+package goproxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// HostMatcher matches hostnames against a large list of patterns in time proportional to the
+// number of labels in the hostname, regardless of the size of the list. Three kinds of pattern
+// are supported:
+//
+//	example.com     matches example.com only
+//	*.example.com   matches any subdomain of example.com, but not example.com itself
+//	.example.com    matches the whole site: the registrable domain of the pattern, as found by
+//	                GetSubdomains, and every subdomain of it, so .www.example.co.uk covers
+//	                example.co.uk.
+//
+// Matching ignores case, ports and trailing dots. The pattern list can be replaced at any time
+// without blocking concurrent calls to Match.
+type HostMatcher struct {
+	trie atomic.Value // *hostTrie
+}
+
+// A node in a trie of reversed domain labels: "www.example.com" is stored as com -> example -> www.
+type hostTrie struct {
+	children   map[string]*hostTrie
+	exact      bool // A pattern ends at this node
+	subdomains bool // Every host below this node matches
+}
+
+// NewHostMatcher returns a matcher for the given patterns.
+func NewHostMatcher(patterns ...string) *HostMatcher {
+	m := &HostMatcher{}
+	m.Replace(patterns)
+	return m
+}
+
+// Replace atomically swaps the matcher's patterns for a new list. Invalid patterns are skipped.
+func (m *HostMatcher) Replace(patterns []string) {
+	root := &hostTrie{}
+	for _, pattern := range patterns {
+		root.insert(pattern)
+	}
+	m.trie.Store(root)
+}
+
+// Match reports whether host (with or without a port) matches any of the patterns.
+func (m *HostMatcher) Match(host string) bool {
+	root, _ := m.trie.Load().(*hostTrie)
+	if root == nil {
+		return false
+	}
+
+	host = normalizeHost(stripHostPort(host))
+	if host == "" {
+		return false
+	}
+
+	node := root
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			return false
+		}
+		if node.subdomains && i > 0 {
+			return true
+		}
+	}
+	return node.exact
+}
+
+func (t *hostTrie) insert(pattern string) {
+	pattern = normalizeHost(pattern)
+
+	var exact, subdomains bool
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		pattern = pattern[2:]
+		subdomains = true
+	case strings.HasPrefix(pattern, "."):
+		// The last of the subdomains is the site, or the pattern itself if it's already a
+		// public suffix. IP addresses are matched literally.
+		pattern = pattern[1:]
+		if net.ParseIP(pattern) == nil {
+			names := GetSubdomains(pattern)
+			pattern = names[len(names)-1]
+		}
+		exact, subdomains = true, true
+	default:
+		exact = true
+	}
+
+	if pattern == "" || strings.Contains(pattern, "*") {
+		return
+	}
+
+	node := t
+	labels := strings.Split(pattern, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*hostTrie)
+		}
+		child := node.children[labels[i]]
+		if child == nil {
+			child = &hostTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.exact = node.exact || exact
+	node.subdomains = node.subdomains || subdomains
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// Returns host without its port, if it has one.
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// HostMatches is a middleware which only calls the chained handler when the destination host
+// matches m. It can be used on both connect and request handlers.
+func HostMatches(m *HostMatcher) ChainedHandler {
+	return CondHostMatches(m).Chain()
+}
+
+// CondHostMatches is the Condition behind HostMatches.
+func CondHostMatches(m *HostMatcher) Condition {
+	return func(ctx *ProxyCtx) bool {
+		host := ctx.Host()
+		if host == "" && ctx.Req != nil {
+			host = ctx.Req.Host
+		}
+		return m.Match(host)
+	}
+}
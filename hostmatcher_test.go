@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHostMatcher(t *testing.T) {
+	Convey("Hosts are matched against exact, wildcard and site patterns", t, func() {
+		m := NewHostMatcher(
+			"example.com",
+			"*.tracker.net",
+			".www.example.co.uk",
+			".cdn.googleapis.com",
+			"Ads.Example.ORG.",
+			"10.0.0.1",
+			".10.0.0.2",
+		)
+
+		So(m.Match("example.com"), ShouldBeTrue)
+		So(m.Match("example.com:443"), ShouldBeTrue)
+		So(m.Match("EXAMPLE.com."), ShouldBeTrue)
+		So(m.Match("www.example.com"), ShouldBeFalse)
+
+		So(m.Match("tracker.net"), ShouldBeFalse)
+		So(m.Match("a.tracker.net"), ShouldBeTrue)
+		So(m.Match("a.b.tracker.net:80"), ShouldBeTrue)
+		So(m.Match("nottracker.net"), ShouldBeFalse)
+
+		So(m.Match("example.co.uk"), ShouldBeTrue)
+		So(m.Match("static.example.co.uk"), ShouldBeTrue)
+		So(m.Match("co.uk"), ShouldBeFalse)
+
+		// Sites are found the same way as the wildcard certificates' parent domains.
+		So(m.Match("googleapis.com"), ShouldBeTrue)
+		So(m.Match("www.googleapis.com"), ShouldBeTrue)
+
+		So(m.Match("ads.example.org"), ShouldBeTrue)
+		So(m.Match("example.org"), ShouldBeFalse)
+
+		So(m.Match("10.0.0.1:80"), ShouldBeTrue)
+		So(m.Match("10.0.0.2"), ShouldBeTrue)
+		So(m.Match("10.0.0.3"), ShouldBeFalse)
+		So(m.Match(""), ShouldBeFalse)
+	})
+}
+
+func TestHostMatcherReplace(t *testing.T) {
+	Convey("Replace swaps the pattern list", t, func() {
+		m := NewHostMatcher("example.com")
+		So(m.Match("example.com"), ShouldBeTrue)
+
+		m.Replace([]string{"*.example.org"})
+		So(m.Match("example.com"), ShouldBeFalse)
+		So(m.Match("www.example.org"), ShouldBeTrue)
+	})
+
+	Convey("The zero value matches nothing", t, func() {
+		var empty HostMatcher
+		So(empty.Match("example.com"), ShouldBeFalse)
+	})
+}
+
+func TestHostMatchesFilter(t *testing.T) {
+	Convey("HostMatches only calls the handler for matching hosts", t, func() {
+		m := NewHostMatcher("*.tracker.net")
+		reject := HandlerFunc(func(ctx *ProxyCtx) Next { return REJECT })
+		h := HostMatches(m)(reject)
+
+		So(h.Handle(&ProxyCtx{host: "a.tracker.net:443"}), ShouldEqual, REJECT)
+		So(h.Handle(requestCtx("example.com", "")), ShouldEqual, NEXT)
+	})
+}
+
+func BenchmarkHostMatcher(b *testing.B) {
+	patterns := make([]string, 100000)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("*.tracker%d.example.com", i)
+	}
+	m := NewHostMatcher(patterns...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match("a.b.tracker99999.example.com:443")
+	}
+}
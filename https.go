@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 // returns only the hostname
@@ -79,18 +80,30 @@ func (proxy *ProxyHttpServer) TestConnectDialContext(ctx context.Context, networ
 func (proxy *ProxyHttpServer) connectDialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
 	//fmt.Println("[DEBUG] connectDialContext()")
 	//panic("stack trace")
-	if proxy.ConnectDialContext == nil {
-		// This is the default for https connections
-		return proxy.dialContext(ctx, network, addr)
-	}
-
 	// ctx must be non-nil. Ensure we always have one.
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	// This would be hit if we defined a custom dialer (we don't)
-	return proxy.ConnectDialContext(ctx, network, addr)
+	start := time.Now()
+	if proxy.ConnectDialContext == nil {
+		// This is the default for https connections
+		c, err = proxy.dialContext(ctx, network, addr)
+	} else {
+		// This would be hit if we defined a custom dialer (we don't)
+		c, err = proxy.ConnectDialContext(ctx, network, addr)
+	}
+	proxy.Metrics.observeDial(time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Announce the original client to the upstream server if SendProxyProtocol is set.
+	if err := writeProxyProtocolHeader(ctx, c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 // Returns a context dialer for a proxy if specified by the environment
@@ -0,0 +1,189 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPSet is a set of IPv4 and IPv6 networks stored in a binary radix tree, so that lookups take
+// at most one step per address bit no matter how many networks it holds. IPv4 addresses are
+// stored in their IPv4-mapped IPv6 form.
+//
+// An IPSet must not be modified once it is in use by a running proxy.
+type IPSet struct {
+	root ipSetNode
+	size int
+}
+
+type ipSetNode struct {
+	children [2]*ipSetNode
+	terminal bool // A network ends here. Every address below this node is in the set.
+}
+
+// ParseIPSet builds an IPSet from a list of networks in CIDR notation ("192.168.102.0/24",
+// "fd00::/8") or single addresses.
+func ParseIPSet(cidrs ...string) (*IPSet, error) {
+	s := &IPSet{}
+	for _, cidr := range cidrs {
+		if err := s.Add(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// MustParseIPSet is like ParseIPSet but panics if any of the networks can't be parsed. It
+// simplifies the initialization of global variables and filters.
+func MustParseIPSet(cidrs ...string) *IPSet {
+	s, err := ParseIPSet(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Add adds a network in CIDR notation, or a single address, to the set.
+func (s *IPSet) Add(cidr string) error {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("goproxy: invalid IP address %q", cidr)
+		}
+		s.AddNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip.To16())*8, len(ip.To16())*8)})
+		return nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("goproxy: invalid network %q: %v", cidr, err)
+	}
+	s.AddNet(ipnet)
+	return nil
+}
+
+// AddNet adds a network to the set.
+func (s *IPSet) AddNet(ipnet *net.IPNet) {
+	ones, bits := ipnet.Mask.Size()
+	if bits == net.IPv4len*8 {
+		// Offset IPv4 prefixes by the ::ffff:0:0/96 mapping.
+		ones += 96
+	}
+	ip := ipnet.IP.To16()
+
+	node := &s.root
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			// Already covered by a shorter prefix.
+			return
+		}
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipSetNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.terminal {
+		return
+	}
+	// Longer prefixes below this one are now redundant.
+	s.size -= node.count()
+	node.terminal = true
+	node.children = [2]*ipSetNode{}
+	s.size++
+}
+
+// Returns the number of networks which end at or below n.
+func (n *ipSetNode) count() int {
+	if n == nil {
+		return 0
+	}
+	if n.terminal {
+		return 1
+	}
+	return n.children[0].count() + n.children[1].count()
+}
+
+// Contains reports whether ip is in any of the networks in the set.
+func (s *IPSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	node := &s.root
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(ip)*8 {
+			return false
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return false
+}
+
+// ContainsHost reports whether host, an IP address with or without a port, is in the set.
+// Hostnames never match.
+func (s *IPSet) ContainsHost(host string) bool {
+	ip := net.ParseIP(strings.Trim(stripHostPort(host), "[]"))
+	return ip != nil && s.Contains(ip)
+}
+
+// Len returns the number of networks in the set. Duplicates and networks covered by a shorter
+// prefix aren't counted.
+func (s *IPSet) Len() int {
+	return s.size
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// SourceIPIn matches connections and requests from clients in any of the given networks. It
+// panics if a network can't be parsed; use SourceIPInSet for networks loaded at runtime.
+func SourceIPIn(cidrs ...string) Condition {
+	return SourceIPInSet(MustParseIPSet(cidrs...))
+}
+
+// SourceIPInSet matches connections and requests from clients in set.
+func SourceIPInSet(set *IPSet) Condition {
+	return func(ctx *ProxyCtx) bool {
+		if addr, ok := ctx.ClientAddr.(*net.TCPAddr); ok {
+			return set.Contains(addr.IP)
+		}
+		if ctx.SourceIP != "" {
+			return set.ContainsHost(ctx.SourceIP)
+		}
+		return ctx.Req != nil && set.ContainsHost(ctx.Req.RemoteAddr)
+	}
+}
+
+// DestinationIPIn matches connections and requests to any of the given networks. It panics if
+// a network can't be parsed; use DestinationIPInSet for networks loaded at runtime.
+func DestinationIPIn(cidrs ...string) Condition {
+	return DestinationIPInSet(MustParseIPSet(cidrs...))
+}
+
+// DestinationIPInSet matches connections and requests to set. If the destination is a hostname
+// (SNI or an HTTP Host header), the address the client originally connected to is used instead.
+func DestinationIPInSet(set *IPSet) Condition {
+	return func(ctx *ProxyCtx) bool {
+		host := ctx.Host()
+		if host == "" && ctx.Req != nil {
+			host = ctx.Req.Host
+		}
+		if set.ContainsHost(host) {
+			return true
+		}
+		if net.ParseIP(strings.Trim(stripHostPort(host), "[]")) != nil {
+			return false
+		}
+		return set.ContainsHost(ctx.OriginalDestination())
+	}
+}
@@ -0,0 +1,147 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIPSet(t *testing.T) {
+	s, err := ParseIPSet("192.168.102.0/24", "10.0.0.1", "fd00::/8", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"192.168.102.1", true},
+		{"192.168.102.255", true},
+		{"192.168.103.1", false},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"fd12:3456::1", true},
+		{"fe80::1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"::ffff:192.168.102.7", true},
+	}
+	for _, tt := range tests {
+		if got := s.Contains(net.ParseIP(tt.ip)); got != tt.contains {
+			t.Errorf("Contains(%s) = %t, want %t", tt.ip, got, tt.contains)
+		}
+	}
+
+	if !s.ContainsHost("192.168.102.5:443") || !s.ContainsHost("[fd00::1]:443") || s.ContainsHost("example.com:443") {
+		t.Error("ContainsHost() doesn't handle ports and hostnames")
+	}
+
+	if _, err := ParseIPSet("192.168.102.0/33"); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+	if _, err := ParseIPSet("not an ip"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+
+	var nilset *IPSet
+	if nilset.Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("nil IPSet should be empty")
+	}
+}
+
+func TestIPSetShorterPrefixWins(t *testing.T) {
+	s := MustParseIPSet("10.1.2.0/24", "10.0.0.0/8", "10.2.0.0/16")
+	if !s.Contains(net.ParseIP("10.99.0.1")) || !s.Contains(net.ParseIP("10.1.2.3")) {
+		t.Error("expected 10.0.0.0/8 to cover its subnets")
+	}
+	if s.Contains(net.ParseIP("11.0.0.1")) {
+		t.Error("11.0.0.1 shouldn't match")
+	}
+	if s.Len() != 1 {
+		t.Errorf("got Len() = %d, want 1", s.Len())
+	}
+
+	s = MustParseIPSet("10.1.2.0/24", "10.1.3.0/24", "10.1.2.0/24", "192.168.0.1")
+	if s.Len() != 3 {
+		t.Errorf("got Len() = %d with a duplicate network, want 3", s.Len())
+	}
+	s.Add("10.1.0.0/16")
+	if s.Len() != 2 {
+		t.Errorf("got Len() = %d after covering two networks, want 2", s.Len())
+	}
+}
+
+func TestSourceAndDestinationIPIn(t *testing.T) {
+	devices := SourceIPIn("192.168.102.0/24", "fd00::/8")
+	private := DestinationIPIn("10.0.0.0/8")
+
+	// TLS-sniffed and CONNECT contexts carry the client address and host:port.
+	ctx := &ProxyCtx{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.168.102.20"), Port: 5555},
+		host:       "10.1.2.3:443",
+		Req:        &http.Request{URL: &url.URL{}},
+	}
+	if !devices(ctx) || !private(ctx) {
+		t.Error("expected TLS context to match source and destination")
+	}
+
+	// Plain HTTP contexts built by hand may only have the request.
+	ctx = requestCtx("example.com", "[fd00::20]:5555")
+	if !devices(ctx) {
+		t.Error("expected IPv6 client to match")
+	}
+	if private(ctx) {
+		t.Error("hostname without a known original destination shouldn't match")
+	}
+
+	ctx = requestCtx("example.com", "192.168.1.20:5555")
+	if devices(ctx) {
+		t.Error("192.168.1.20 shouldn't match 192.168.102.0/24")
+	}
+}
+
+func TestDestinationIPInCachesFailedLookups(t *testing.T) {
+	lookups := 0
+	proxy := NewProxyHttpServer()
+	proxy.DestinationResolver = func(c net.Conn) string {
+		lookups++
+		return ""
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	private := DestinationIPIn("10.0.0.0/8")
+	ctx := requestCtx("example.com", "192.168.102.20:5555")
+	ctx.Proxy = proxy
+	ctx.clientConn = server
+	for i := 0; i < 3; i++ {
+		if private(ctx) {
+			t.Error("unresolved destination shouldn't match")
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("destination was looked up %d times, want 1", lookups)
+	}
+}
+
+func TestMatchIsLocalhost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"localhost":        true,
+		"127.0.0.1":        true,
+		"127.0.0.5:8080":   true,
+		"[::1]:443":        true,
+		"::1":              true,
+		"127.0.0.1.nip.io": false,
+		"example.com":      false,
+		"[::2]:443":        false,
+	} {
+		req := &http.Request{URL: &url.URL{Host: host}}
+		if got := MatchIsLocalhost(req); got != want {
+			t.Errorf("MatchIsLocalhost(%s) = %t, want %t", host, got, want)
+		}
+	}
+}
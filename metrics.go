@@ -0,0 +1,493 @@
+package goproxy
+
+import (
+	"bufio"
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request decisions counted by Metrics.
+const (
+	DecisionAllowed         = "allowed"
+	DecisionBlocked         = "blocked"
+	DecisionWhitelisted     = "whitelisted"
+	DecisionTempWhitelisted = "tempwhitelisted"
+)
+
+// Maximum number of label combinations kept per counter. Further combinations are folded into a
+// series per decision with every other label set to "other", so that a client visiting many
+// sites or sending many TLS signatures can't exhaust memory.
+const maxMetricSeries = 10000
+
+// Latency buckets, in seconds, for the dial and time to first byte histograms.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Metrics collects the proxy's counters, gauges and histograms, and serves them in the
+// OpenMetrics text format (which Prometheus also accepts). Mount it on NonProxyHandler or any
+// other http.ServeMux. A nil *Metrics discards everything.
+type Metrics struct {
+	proxy *ProxyHttpServer
+
+	requests   *counterVec // decision, host, signature
+	rejected   *counterVec // reason
+	dialErrors uint64
+	dial       *histogram
+	ttfb       *histogram
+	idle       idleConnTracker
+}
+
+func newMetrics(proxy *ProxyHttpServer) *Metrics {
+	return &Metrics{
+		proxy:    proxy,
+		requests: newCounterVec("decision", "host", "signature"),
+		rejected: newCounterVec("reason"),
+		dial:     newHistogram(latencyBuckets),
+		ttfb:     newHistogram(latencyBuckets),
+		idle:     idleConnTracker{conns: make(map[net.Conn]*list.Element)},
+	}
+}
+
+// CountRequest counts a request to host from a client with the given TLS signature. Requests
+// forwarded or rejected by the proxy are counted automatically; this is for requests which
+// handlers serve themselves.
+func (m *Metrics) CountRequest(decision, host, signature string) {
+	if m == nil {
+		return
+	}
+	m.requests.add(decision, stripHostPort(host), signature)
+}
+
+// Counts an inbound connection dropped by ConnLimits.
+func (m *Metrics) countRejectedConn(reason string) {
+	if m == nil {
+		return
+	}
+	m.rejected.add(reason)
+}
+
+// Counts a forwarded or rejected request.
+func (ctx *ProxyCtx) countRequest(decision string) {
+	if ctx.Proxy == nil || ctx.IgnoreCounter {
+		return
+	}
+	host := ctx.host
+	if host == "" && ctx.Req != nil {
+		host = ctx.Req.Host
+	}
+	ctx.Proxy.Metrics.CountRequest(decision, host, ctx.CipherSignature)
+}
+
+// Counts a request which is being forwarded to its destination.
+func (ctx *ProxyCtx) countForwarded() {
+	switch {
+	case ctx.Whitelisted && ctx.TimeRemaining > 0:
+		ctx.countRequest(DecisionTempWhitelisted)
+	case ctx.Whitelisted:
+		ctx.countRequest(DecisionWhitelisted)
+	default:
+		ctx.countRequest(DecisionAllowed)
+	}
+}
+
+// Records how long it took to dial a destination.
+func (m *Metrics) observeDial(elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&m.dialErrors, 1)
+		return
+	}
+	m.dial.observe(elapsed)
+}
+
+// Returns a trace which records dial latency and time to first byte for a request sent upstream.
+// If trackIdle is set, the request is going through the proxy's own Transport and connections
+// are followed in and out of its idle pool.
+func (m *Metrics) clientTrace(trackIdle bool) *httptrace.ClientTrace {
+	start := time.Now()
+
+	// With dual stack hosts, ConnectStart and ConnectDone may be called concurrently.
+	var mu sync.Mutex
+	dialStart := make(map[string]time.Time)
+
+	var conn net.Conn
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			dialStart[network+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			elapsed := time.Since(dialStart[network+addr])
+			mu.Unlock()
+			m.observeDial(elapsed, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+			if trackIdle && info.WasIdle {
+				m.idle.remove(conn)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if trackIdle && err == nil && conn != nil {
+				m.idle.put(conn, idleConnTimeout(m.proxy.Transport))
+			}
+		},
+		GotFirstResponseByte: func() {
+			m.ttfb.observe(time.Since(start))
+		},
+	}
+}
+
+// Wraps an upstream connection which a request has just been written to, so that the first byte
+// read back from it is recorded as the time to first byte.
+func (m *Metrics) timeFirstByte(c net.Conn) net.Conn {
+	if m == nil {
+		return c
+	}
+	return &firstByteConn{Conn: c, start: time.Now(), ttfb: m.ttfb}
+}
+
+type firstByteConn struct {
+	net.Conn
+	start time.Time
+	once  sync.Once
+	ttfb  *histogram
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() { c.ttfb.observe(time.Since(c.start)) })
+	}
+	return n, err
+}
+
+// ServeHTTP writes the current metrics in the OpenMetrics text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if m == nil {
+		w.Write([]byte("# EOF\n"))
+		return
+	}
+
+	mw := &metricWriter{w: bufio.NewWriter(w)}
+
+	mw.family("goproxy_requests", "counter", "Requests forwarded or rejected by the proxy.")
+	m.requests.write(mw, "goproxy_requests_total")
+
+	mw.family("goproxy_rejected_connections", "counter", "Inbound connections dropped by the proxy's ConnLimits.")
+	m.rejected.write(mw, "goproxy_rejected_connections_total")
+
+	mw.family("goproxy_open_handlers", "gauge", "Connections currently being handled.")
+	mw.sample("goproxy_open_handlers", nil, float64(atomic.LoadInt64(&m.proxy.openhandlers)))
+
+	mw.family("goproxy_transport_idle_connections", "gauge", "Estimated number of idle upstream connections kept by the Transport.")
+	mw.sample("goproxy_transport_idle_connections", nil, float64(m.idle.count(m.proxy.Transport)))
+
+	if m.proxy.MITMCertConfig != nil {
+		stats := m.proxy.MITMCertConfig.CacheStats()
+
+		mw.family("goproxy_cert_cache_entries", "gauge", "Hosts with a cached TLS configuration.")
+		mw.sample("goproxy_cert_cache_entries", nil, float64(stats.Entries))
+
+		mw.family("goproxy_cert_cache_bytes", "gauge", "Approximate memory used by the cached TLS configurations.")
+		mw.sample("goproxy_cert_cache_bytes", nil, float64(stats.Bytes))
+
+		mw.family("goproxy_cert_cache_lookups", "counter", "Lookups in the certificate cache.")
+		mw.sample("goproxy_cert_cache_lookups_total", []string{"result", "hit"}, float64(stats.Hits))
+		mw.sample("goproxy_cert_cache_lookups_total", []string{"result", "miss"}, float64(stats.Misses))
+
+		mw.family("goproxy_cert_cache_evictions", "counter", "Hosts removed from the certificate cache.")
+		mw.sample("goproxy_cert_cache_evictions_total", []string{"reason", "size"}, float64(stats.Evictions))
+		mw.sample("goproxy_cert_cache_evictions_total", []string{"reason", "age"}, float64(stats.Expirations))
+	}
+
+	mw.family("goproxy_dial_errors", "counter", "Upstream connections which couldn't be established.")
+	mw.sample("goproxy_dial_errors_total", nil, float64(atomic.LoadUint64(&m.dialErrors)))
+
+	mw.family("goproxy_dial_duration_seconds", "histogram", "Time taken to connect to upstream servers.")
+	m.dial.write(mw, "goproxy_dial_duration_seconds", nil)
+
+	mw.family("goproxy_upstream_ttfb_seconds", "histogram", "Time from sending a request upstream to receiving the first byte of the response.")
+	m.ttfb.write(mw, "goproxy_upstream_ttfb_seconds", nil)
+
+	m.writeHandlerStats(mw)
+
+	mw.w.WriteString("# EOF\n")
+	mw.w.Flush()
+}
+
+// Exports the per-handler stats collected by the dispatcher.
+func (m *Metrics) writeHandlerStats(mw *metricWriter) {
+	stats := m.proxy.HandlerStats()
+
+	mw.family("goproxy_handler_calls", "counter", "Calls made to each registered handler.")
+	for _, s := range stats {
+		mw.sample("goproxy_handler_calls_total", []string{"stage", s.Stage, "handler", s.Handler}, float64(s.Calls))
+	}
+
+	mw.family("goproxy_handler_panics", "counter", "Calls to each registered handler which panicked.")
+	for _, s := range stats {
+		mw.sample("goproxy_handler_panics_total", []string{"stage", s.Stage, "handler", s.Handler}, float64(s.Panics))
+	}
+
+	mw.family("goproxy_handler_results", "counter", "Next values returned by each registered handler.")
+	for _, s := range stats {
+		for next := NEXT; int(next) < len(nextNames); next++ {
+			if n, ok := s.Results[next]; ok {
+				mw.sample("goproxy_handler_results_total", []string{"stage", s.Stage, "handler", s.Handler, "next", next.String()}, float64(n))
+			}
+		}
+	}
+
+	mw.family("goproxy_handler_duration_seconds", "histogram", "Time spent in each registered handler.")
+	for _, s := range stats {
+		labels := []string{"stage", s.Stage, "handler", s.Handler}
+		for _, b := range s.Latency {
+			le := "+Inf"
+			if b.UpperBound > 0 {
+				le = formatFloat(b.UpperBound.Seconds())
+			}
+			mw.sample("goproxy_handler_duration_seconds_bucket", append(labels, "le", le), float64(b.Count))
+		}
+		mw.sample("goproxy_handler_duration_seconds_sum", labels, s.Total.Seconds())
+		mw.sample("goproxy_handler_duration_seconds_count", labels, float64(s.Calls))
+	}
+}
+
+// Writes metrics in the OpenMetrics text format.
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricWriter) family(name, typ, help string) {
+	mw.w.WriteString("# TYPE " + name + " " + typ + "\n")
+	mw.w.WriteString("# HELP " + name + " " + help + "\n")
+}
+
+// labels holds alternating names and values.
+func (mw *metricWriter) sample(name string, labels []string, value float64) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			mw.w.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// A counter with labels.
+type counterVec struct {
+	labels []string
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	value  uint64
+	values []string
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, series: make(map[string]*counterSeries)}
+}
+
+func (c *counterVec) add(values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	s, ok := c.series[key]
+	if !ok {
+		if len(c.series) >= maxMetricSeries {
+			values = c.overflow(values)
+			key = strings.Join(values, "\xff")
+			s, ok = c.series[key]
+		}
+		if !ok {
+			s = &counterSeries{values: values}
+			c.series[key] = s
+		}
+	}
+	c.mu.Unlock()
+
+	atomic.AddUint64(&s.value, 1)
+}
+
+// Returns the label values to use once a counter has too many series. Every label but the
+// decision is folded, since hosts and signatures are chosen by clients.
+func (c *counterVec) overflow(values []string) []string {
+	folded := make([]string, len(values))
+	copy(folded, values)
+	for i, label := range c.labels {
+		if label != "decision" {
+			folded[i] = "other"
+		}
+	}
+	return folded
+}
+
+func (c *counterVec) write(mw *metricWriter, name string) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*counterSeries, len(keys))
+	for i, key := range keys {
+		series[i] = c.series[key]
+	}
+	c.mu.Unlock()
+
+	labels := make([]string, 2*len(c.labels))
+	for _, s := range series {
+		for i, label := range c.labels {
+			labels[2*i] = label
+			labels[2*i+1] = s.values[i]
+		}
+		mw.sample(name, labels, float64(atomic.LoadUint64(&s.value)))
+	}
+}
+
+// A histogram of durations with fixed buckets.
+type histogram struct {
+	nanos  uint64 // Sum of all observations
+	bounds []float64
+	counts []uint64 // Not cumulative. The last bucket is +Inf.
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.nanos, uint64(d))
+}
+
+func (h *histogram) write(mw *metricWriter, name string, labels []string) {
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		mw.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(count))
+	}
+	mw.sample(name+"_sum", labels, time.Duration(atomic.LoadUint64(&h.nanos)).Seconds())
+	mw.sample(name+"_count", labels, float64(count))
+}
+
+// Estimates the number of idle connections in the Transport's pool. http.Transport doesn't
+// expose this, so we follow connections through the client trace instead. Connections which the
+// server closes while idle are forgotten once they've been idle for longer than the Transport's
+// IdleConnTimeout, or fallbackIdleConnTimeout if it has none.
+type idleConnTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*list.Element
+	lru   list.List // *idleConn, most recently put first
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// How long a connection is assumed to stay in the pool when the Transport has no
+// IdleConnTimeout. The same as http.DefaultTransport's.
+const fallbackIdleConnTimeout = 90 * time.Second
+
+// Returns how long tr keeps a connection idle before closing it.
+func idleConnTimeout(tr *http.Transport) time.Duration {
+	if tr != nil && tr.IdleConnTimeout > 0 {
+		return tr.IdleConnTimeout
+	}
+	return fallbackIdleConnTimeout
+}
+
+// Records c as idle, and forgets connections which have been idle for longer than timeout, so
+// the tracker can't grow while nobody reads the count.
+func (t *idleConnTracker) put(c net.Conn, timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.conns[c]; ok {
+		t.lru.Remove(el)
+	}
+	t.conns[c] = t.lru.PushFront(&idleConn{conn: c, since: time.Now()})
+	t.prune(timeout)
+}
+
+func (t *idleConnTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.conns[c]; ok {
+		t.lru.Remove(el)
+		delete(t.conns, c)
+	}
+}
+
+// Forgets all connections. Called after the Transport's idle connections are closed.
+func (t *idleConnTracker) reset() {
+	t.mu.Lock()
+	t.conns = make(map[net.Conn]*list.Element)
+	t.lru.Init()
+	t.mu.Unlock()
+}
+
+// Removes connections idle for longer than timeout. The caller must hold t.mu.
+func (t *idleConnTracker) prune(timeout time.Duration) {
+	for el := t.lru.Back(); el != nil; el = t.lru.Back() {
+		idle := el.Value.(*idleConn)
+		if time.Since(idle.since) <= timeout {
+			return
+		}
+		t.lru.Remove(el)
+		delete(t.conns, idle.conn)
+	}
+}
+
+func (t *idleConnTracker) count(tr *http.Transport) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(idleConnTimeout(tr))
+
+	n := len(t.conns)
+	if tr != nil && tr.MaxIdleConns > 0 && n > tr.MaxIdleConns {
+		n = tr.MaxIdleConns
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVecOverflow(t *testing.T) {
+	c := newCounterVec("decision", "host", "signature")
+	for i := 0; i < maxMetricSeries+10; i++ {
+		c.add(DecisionAllowed, fmt.Sprintf("host%d.example.com", i), "sig")
+	}
+	if len(c.series) != maxMetricSeries+1 {
+		t.Errorf("got %d series, want %d", len(c.series), maxMetricSeries+1)
+	}
+	if s := c.series[strings.Join([]string{DecisionAllowed, "other", "other"}, "\xff")]; s == nil || s.value != 10 {
+		t.Errorf("overflow series is %+v, want 10 requests", s)
+	}
+
+	// Signatures are chosen by clients too, so they're folded as well.
+	c = newCounterVec("decision", "host", "signature")
+	for i := 0; i < 2*maxMetricSeries; i++ {
+		c.add(DecisionAllowed, "example.com", fmt.Sprintf("sig%d", i))
+	}
+	c.add(DecisionBlocked, "example.com", "sig")
+	if len(c.series) != maxMetricSeries+2 {
+		t.Errorf("got %d series, want %d", len(c.series), maxMetricSeries+2)
+	}
+	if s := c.series[strings.Join([]string{DecisionAllowed, "other", "other"}, "\xff")]; s == nil || s.value != maxMetricSeries {
+		t.Errorf("overflow series is %+v, want %d requests", s, maxMetricSeries)
+	}
+}
+
+func TestMetricWriter(t *testing.T) {
+	var buf bytes.Buffer
+	mw := &metricWriter{w: bufio.NewWriter(&buf)}
+
+	h := newHistogram([]float64{.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(5 * time.Second)
+	h.write(mw, "test_seconds", []string{"host", `a"b\c`})
+	mw.w.Flush()
+
+	want := `test_seconds_bucket{host="a\"b\\c",le="0.1"} 1
+test_seconds_bucket{host="a\"b\\c",le="1"} 2
+test_seconds_bucket{host="a\"b\\c",le="+Inf"} 3
+test_seconds_sum{host="a\"b\\c"} 5.55
+test_seconds_count{host="a\"b\\c"} 3
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestIdleConnTrackerPrunesOnPut(t *testing.T) {
+	tracker := idleConnTracker{conns: make(map[net.Conn]*list.Element)}
+
+	// Connections which are never reused are forgotten without the count being read.
+	for i := 0; i < 10; i++ {
+		c, _ := net.Pipe()
+		tracker.put(c, 10*time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	c, _ := net.Pipe()
+	tracker.put(c, 10*time.Millisecond)
+	if len(tracker.conns) != 1 || tracker.lru.Len() != 1 {
+		t.Errorf("got %d tracked connections, want 1", len(tracker.conns))
+	}
+
+	// Putting a connection again doesn't track it twice.
+	tracker.put(c, time.Hour)
+	if tracker.lru.Len() != 1 {
+		t.Errorf("got %d tracked connections after putting one again, want 1", tracker.lru.Len())
+	}
+	tracker.remove(c)
+	if len(tracker.conns) != 0 || tracker.lru.Len() != 0 {
+		t.Errorf("got %d tracked connections after remove, want 0", len(tracker.conns))
+	}
+
+	// Without an IdleConnTimeout, the fallback applies.
+	if got := idleConnTimeout(&http.Transport{}); got != fallbackIdleConnTimeout {
+		t.Errorf("got timeout %v, want %v", got, fallbackIdleConnTimeout)
+	}
+}
@@ -0,0 +1,148 @@
+package goproxy
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// X.509 extensions which are copied as they are, rather than through the fields of
+// x509.Certificate, so that nothing the x509 package doesn't parse is lost.
+var (
+	oidExtensionSCTList             = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+)
+
+// MirrorProfile selects which attributes of an origin server's certificate are copied into the
+// certificate GoproxyConfigServer signs for it, so that applications inspecting the certificate
+// see the same details through the proxy.
+type MirrorProfile struct {
+	Subject        bool
+	Validity       bool // NotBefore and NotAfter
+	KeyUsage       bool
+	ExtKeyUsage    bool // Including unknown extended key usages
+	AuthorityKeyId bool
+	IPAddresses    bool
+	DNSNames       bool
+	SCTs           bool // Embedded signed certificate timestamps, whose signatures won't match the copy
+	Policies       bool // Certificate policies, including their qualifiers
+
+	// Copy the origin's subject key ID instead of using the key ID of the proxy's leaf key. The
+	// copy then names a key it doesn't hold, which can make clients that look certificates up by
+	// key ID pick the origin's certificate, or build the wrong chain. FullMirrorProfile leaves it
+	// unset.
+	SubjectKeyId bool
+
+	// Name the parent domain's wildcard, such as *.example.com for www.example.com, alongside the
+	// host in certificates whose DNS names aren't copied. Hosts directly under a public suffix,
+	// such as example.co.uk, and IP addresses are named exactly.
+	WildcardSANs bool
+}
+
+var (
+	// DefaultMirrorProfile copies the attributes which the signer has always copied.
+	DefaultMirrorProfile = MirrorProfile{
+		Subject:        true,
+		Validity:       true,
+		KeyUsage:       true,
+		AuthorityKeyId: true,
+		IPAddresses:    true,
+		DNSNames:       true,
+	}
+
+	// FullMirrorProfile copies every attribute which MirrorProfile supports, except SubjectKeyId.
+	FullMirrorProfile = MirrorProfile{
+		Subject:        true,
+		Validity:       true,
+		KeyUsage:       true,
+		ExtKeyUsage:    true,
+		AuthorityKeyId: true,
+		IPAddresses:    true,
+		DNSNames:       true,
+		SCTs:           true,
+		Policies:       true,
+	}
+)
+
+// Returns the profile used for new certificates.
+func (c *GoproxyConfigServer) mirrorProfile() *MirrorProfile {
+	if c.Mirror != nil {
+		return c.Mirror
+	}
+	return &DefaultMirrorProfile
+}
+
+// Copies the selected attributes of origcert into tmpl. The validity is copied by the caller,
+// since it depends on whether origcert could be verified.
+func (p *MirrorProfile) apply(tmpl *x509.Certificate, origcert *x509.Certificate) {
+	if p.Subject {
+		tmpl.Subject = origcert.Subject
+	}
+	if p.KeyUsage {
+		tmpl.KeyUsage = origcert.KeyUsage
+	}
+	if p.ExtKeyUsage {
+		tmpl.ExtKeyUsage = origcert.ExtKeyUsage
+		tmpl.UnknownExtKeyUsage = origcert.UnknownExtKeyUsage
+	}
+	if p.AuthorityKeyId {
+		tmpl.AuthorityKeyId = origcert.AuthorityKeyId
+	}
+	if p.SubjectKeyId {
+		tmpl.SubjectKeyId = origcert.SubjectKeyId
+	}
+	if p.IPAddresses {
+		tmpl.IPAddresses = origcert.IPAddresses
+	}
+
+	// If the DNS name points to winston.conf, then use the original hostname.
+	if p.DNSNames && len(origcert.DNSNames) > 0 && origcert.DNSNames[0] != "winston.conf" {
+		tmpl.DNSNames = origcert.DNSNames
+	}
+
+	if p.SCTs {
+		copyExtension(tmpl, origcert, oidExtensionSCTList)
+	}
+	if p.Policies {
+		copyExtension(tmpl, origcert, oidExtensionCertificatePolicies)
+	}
+}
+
+func copyExtension(tmpl *x509.Certificate, origcert *x509.Certificate, id asn1.ObjectIdentifier) {
+	for _, ext := range origcert.Extensions {
+		if ext.Id.Equal(id) {
+			tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+		}
+	}
+}
+
+// Returns the DNS names for a certificate which isn't copying the origin's.
+func (p *MirrorProfile) dnsNames(host string) []string {
+	if p.WildcardSANs {
+		if wildcard, ok := wildcardSAN(host); ok {
+			return []string{host, wildcard}
+		}
+	}
+	return []string{host}
+}
+
+// Returns the wildcard name covering host, as given by getWildcardHost, if clients would accept
+// it. A wildcard only matches a single label, so it always covers host, but clients reject
+// wildcards for a public suffix (*.co.uk) and names which aren't domains.
+func wildcardSAN(host string) (string, bool) {
+	if net.ParseIP(host) != nil {
+		return "", false
+	}
+	wildcard := getWildcardHost(host)
+	if !strings.HasPrefix(wildcard, "*.") {
+		return "", false
+	}
+	parent := wildcard[2:]
+	if suffix, _ := publicsuffix.PublicSuffix(parent); suffix == parent {
+		return "", false
+	}
+	return wildcard, true
+}
@@ -5,6 +5,7 @@ package goproxy
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -26,7 +27,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/winstonprivacyinc/go-conntrack"
 
 	//"crypto/tls"
 	"github.com/winstonprivacyinc/winston/shadownetwork"
@@ -66,11 +66,11 @@ type ProxyHttpServer struct {
 	SniffSNI bool
 	Logger   *log.Logger
 
-	// Registered handlers
-	connectHandlers  []Handler
-	requestHandlers  []Handler
-	responseHandlers []Handler
-	doneHandlers     []Handler
+	// Registered handlers. These may be modified while requests are being dispatched.
+	connectHandlers  handlerList
+	requestHandlers  handlerList
+	responseHandlers handlerList
+	doneHandlers     handlerList
 
 	// NonProxyHandler will be used to handle direct connections to the proxy. You can
 	// assign an `http.ServeMux` or some other routing libs here.  The default will return
@@ -110,25 +110,83 @@ type ProxyHttpServer struct {
 	// Closure to give listeners a chance to service a request directly. Return true if handled.
 	HandleHTTP func(ctx *ProxyCtx) bool
 
+	// Called with the final totals when a tunnel opened by ForwardConnect() or ForwardRequest()
+	// closes. See Tunnels() for those which are still open.
+	OnTunnelClosed func(ctx *ProxyCtx, tunnel TunnelInfo)
+
+	// Called when a handler panics or returns a Next value which isn't valid where it was called.
+	// The error has already been logged and the client connection closed.
+	OnHandlerError func(ctx *ProxyCtx, err *HandlerError)
+
 	// If set to true, then the next HTTP request will flush all idle connections. Will be reset to false afterwards.
 	FlushIdleConnections bool
 
 	// RoundTripper which supports non-http protocols
 	NonHTTPRoundTripper *NonHTTPRoundTripper
 
-	UpdateAllowedCounter     func(string, string, string, int, int, int)
-	UpdateBlockedCounter     func(string, string, string, int, bool)
-	UpdateWhitelistedCounter func(string, string, string, int)
-	UpdateTempWhitelistedCounter func(string, string, string, int)
+	// Request counters, gauges and latency histograms. Serve them by mounting Metrics on
+	// NonProxyHandler. Set to nil to disable collection.
+	Metrics *Metrics
 
-	// Defaults to a conntrak lookup but callers may substitute their own function (intended
-	// primarily for unit testing). The connection must not be used or closed.
+	// Defaults to looking the destination up with OriginalDestinationResolver but callers may
+	// substitute their own function (intended primarily for unit testing). The connection must
+	// not be used or closed.
 	DestinationResolver func(c net.Conn) string
 
+	// Determines the original destination of connections which don't name it themselves (non-SNI
+	// TLS clients and non-HTTP protocols) when DestinationResolver is left at its default. Defaults
+	// to SO_ORIGINAL_DST followed by a conntrak lookup, but callers may chain their own resolvers
+	// (see NewChainedResolver).
+	OriginalDestinationResolver DestinationResolver
+
+	// If set, every inbound connection must begin with a PROXY protocol (v1 or v2) header, as sent
+	// by HAProxy and most load balancers. The client and original destination addresses it carries
+	// replace those of the socket. Connections without a valid header are dropped.
+	AcceptProxyProtocol bool
+
+	// Limits on concurrent and new connections, overall and per client IP. Connections over a
+	// limit are dropped before their ClientHello or request is read.
+	ConnLimits ConnLimits
+
+	// If set, ctx.DeviceLabel is looked up here from the client's JA4, JA3 or cipher signature
+	// before the connect and request handlers run.
+	Fingerprints *FingerprintDB
+
+	// PROXY protocol version (1 or 2) to send ahead of upstream connections opened by ForwardConnect()
+	// and ForwardRequest(). Defaults to 0, which sends nothing.
+	SendProxyProtocol int
+
+	// Networks which belong to the proxy itself. TLS connections whose only known destination is
+	// an address in one of these networks are dropped. Defaults to 192.168.102.0/24.
+	LocalNetworks *IPSet
+
 	// Track # of running handlers. Ideally this is equivalent to the # of open connections.
 	openhandlers int64
+
+	// Client connections currently fused to an upstream connection.
+	tunnels tunnelRegistry
+
+	// Bandwidth limits set through ProxyCtx.SetRateLimit() and SetDestinationRateLimit().
+	rateLimits rateLimitRegistry
+
+	// Enforces ConnLimits.
+	connLimiter connLimiter
+
+	// Listeners and connections that Shutdown() needs to close. idleconns holds the client
+	// connections in activeconns which haven't sent a request yet. Guarded by servemu.
+	servemu     sync.Mutex
+	listeners   map[*net.Listener]struct{}
+	activeconns map[net.Conn]struct{}
+	idleconns   map[net.Conn]struct{}
+	inshutdown  int32
 }
 
+// ErrProxyClosed is returned by the Serve and ListenAndServe functions after a call to Shutdown().
+var ErrProxyClosed = errors.New("goproxy: proxy closed")
+
+// How often Shutdown() checks whether the remaining handlers have completed.
+const shutdownPollInterval = 250 * time.Millisecond
+
 // Performs sanity checking against a domain name. Is not intended to be a full blown
 // domain name validator nor perform DNS lookup to confirm the host exists.
 //
@@ -151,10 +209,7 @@ func checkDomain(host string) bool {
 // New proxy server, logs to StdErr by default
 func NewProxyHttpServer() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
-		Logger:           log.New(os.Stderr, "", log.LstdFlags),
-		requestHandlers:  []Handler{},
-		responseHandlers: []Handler{},
-		connectHandlers:  []Handler{},
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
 		NonProxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
@@ -200,7 +255,10 @@ func NewProxyHttpServer() *ProxyHttpServer {
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 	proxy.ConnectDialContext = dialerFromEnvContext(&proxy)
 
-	proxy.DestinationResolver = resolveconntrackdestination
+	proxy.DestinationResolver = proxy.resolveDestination
+	proxy.OriginalDestinationResolver = defaultDestinationResolver()
+	proxy.LocalNetworks = MustParseIPSet("192.168.102.0/24")
+	proxy.Metrics = newMetrics(&proxy)
 
 	return &proxy
 }
@@ -230,88 +288,378 @@ func (proxy *ProxyHttpServer) SetSignature(signature string) {
 // Experimental version of ListenAndServe which allows us to handle our own request processing.
 // Should only be used for unencrypted (port 80) requests.
 func (proxy *ProxyHttpServer) ListenAndServe(addr string) error {
-	ln, err := net.Listen("tcp", addr)
+	if proxy.shuttingDown() {
+		return ErrProxyClosed
+	}
 
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("Error listening for HTTP connections (err 1) - %v", err)
+		return fmt.Errorf("error listening for HTTP connections on %s: %v", addr, err)
 	}
 
+	return proxy.ServeHTTPListener(ln)
+}
+
+// ServeHTTPListener accepts unencrypted (port 80) connections on any net.Listener, such as a
+// socket activated by systemd or an in-memory listener, and handles each of them in a new
+// goroutine. It blocks until the listener fails or Shutdown() is called, in which case it
+// returns ErrProxyClosed. The listener is always closed when ServeHTTPListener returns.
+//
+// A single proxy may serve any number of HTTP and TLS listeners concurrently.
+func (proxy *ProxyHttpServer) ServeHTTPListener(ln net.Listener) error {
+	return proxy.serve(ln, proxy.handleHTTPConnection)
+}
+
+// Serve is equivalent to ServeHTTPListener.
+func (proxy *ProxyHttpServer) Serve(ln net.Listener) error {
+	return proxy.ServeHTTPListener(ln)
+}
+
+// Shutdown gracefully shuts down the proxy. It closes all open listeners and the client
+// connections which haven't sent a request yet, and then waits for the running handlers to
+// finish. If ctx expires first, the remaining client and upstream connections are forcibly
+// closed and ctx.Err() is returned. Once Shutdown has been called, the Serve and
+// ListenAndServe functions return ErrProxyClosed.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&proxy.inshutdown, 1)
+
+	proxy.servemu.Lock()
+	var err error
+	for ln := range proxy.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(proxy.listeners, ln)
+	}
+	proxy.servemu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		proxy.closeIdleConns()
+		if atomic.LoadInt64(&proxy.openhandlers) == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			proxy.closeActiveConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (proxy *ProxyHttpServer) shuttingDown() bool {
+	return atomic.LoadInt32(&proxy.inshutdown) != 0
+}
+
+// Accept loop shared by the HTTP and TLS listeners. Each connection is passed to handle
+// in its own goroutine and is counted in openhandlers until handle returns.
+func (proxy *ProxyHttpServer) serve(l net.Listener, handle func(c net.Conn)) error {
+	ln := net.Listener(&onceCloseListener{Listener: l})
+	defer ln.Close()
+
+	if !proxy.trackListener(&ln, true) {
+		return ErrProxyClosed
+	}
+	defer proxy.trackListener(&ln, false)
+
+	var tempDelay time.Duration
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			log.Printf("Error accepting new HTTP connection (err 2) - %v", err)
-			continue
+			if proxy.shuttingDown() {
+				return ErrProxyClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				proxy.Logf(1, "Error accepting connection: %v. Retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		// The proxy-wide limits are applied before starting a goroutine, so that a flood of
+		// connections costs as little as possible. The client's address isn't known until the
+		// PROXY header is read, so in that case its limits are applied afterwards.
+		limits := proxy.ConnLimits
+		var ip string
+		if limits != (ConnLimits{}) {
+			if !proxy.AcceptProxyProtocol {
+				ip = remoteIP(c)
+			}
+			if reason, ok := proxy.connLimiter.admit(limits, ip); !ok {
+				proxy.Logf(2, "Dropping connection from %s: %s limit exceeded", c.RemoteAddr(), reason)
+				proxy.Metrics.countRejectedConn(reason)
+				rejectConn(c)
+				continue
+			}
 		}
 
+		atomic.AddInt64(&proxy.openhandlers, 1)
+		proxy.trackIdleConn(c)
 		go func(c net.Conn) {
-			//log.Printf("[INFO] Incoming HTTP request - source: %s / destination: %s", c.RemoteAddr().String(), c.LocalAddr().String())
-			atomic.AddInt64(&proxy.openhandlers, 1)
 			defer func() {
+				proxy.trackConn(c, false)
 				atomic.AddInt64(&proxy.openhandlers, -1)
 			}()
 
-			var buf bytes.Buffer
-			tee := io.TeeReader(c, &buf)
-			connteereader := bufio.NewReader(tee)
-
-			var req *http.Request
-			req, err = http.ReadRequest(connteereader)
+			if limits != (ConnLimits{}) {
+				defer proxy.connLimiter.release(ip)
+			}
 
-			if err != nil {
-				// TODO: Try to recover as much information from the original request
-				// as possible so that we can act on headers that might actually be
-				// there (especially referrer and user agent)
-				//fmt.Printf("[DEBUG] ServeHTTP() - Couldn't parse request: %s\nOriginal Request:\n%s\n", err.Error(), string(buf.Bytes()))
-
-				req = &http.Request{
-					Method: "",
-					//URL:	&url.URL{
-					//Host: net.JoinHostPort(Host, "80"),
-					//},
-					Proto:      "http", // assume http, but it's probably not.
-					ProtoMajor: 0,
-					ProtoMinor: 0,
-					Header:     make(http.Header),
-					Body:       nil,
-					Host:       "",
-					//RequestURI: Host,
+			if proxy.AcceptProxyProtocol {
+				pc, err := newProxyProtoConn(c, proxyProtocolHeaderTimeout)
+				if err != nil {
+					proxy.Logf(1, "Dropping connection from %s: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				c = pc
+
+				if limits != (ConnLimits{}) {
+					ip := remoteIP(c)
+					if reason, ok := proxy.connLimiter.admitIP(limits, ip); !ok {
+						proxy.Logf(2, "Dropping connection from %s: %s limit exceeded", c.RemoteAddr(), reason)
+						proxy.Metrics.countRejectedConn(reason)
+						rejectConn(c)
+						return
+					}
+					defer proxy.connLimiter.releaseIP(ip)
 				}
-				//isnonhttpprotocol = true
-
 			}
 
-			// To print any local responses (errors) to stdout, uncomment SpyConnection.
-			// This will not print out anything related to forwarded connections.
-			// resp := notsodumbResponseWriter{Conn: &SpyConnection{c}, ResponseHeader: &req.Header}
+			handle(c)
+		}(c)
+	}
+}
 
-			resp := notsodumbResponseWriter{Conn: c, ResponseHeader: &req.Header}
+// Adds or removes a listener from the set closed by Shutdown(). Returns false if the
+// listener could not be added because the proxy is shutting down.
+func (proxy *ProxyHttpServer) trackListener(ln *net.Listener, add bool) bool {
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	if add {
+		if proxy.shuttingDown() {
+			return false
+		}
+		if proxy.listeners == nil {
+			proxy.listeners = make(map[*net.Listener]struct{})
+		}
+		proxy.listeners[ln] = struct{}{}
+	} else {
+		delete(proxy.listeners, ln)
+	}
+	return true
+}
 
-			// Failover Host detection - if we couldn't read the host from the HTTP headers, check the
-			// conntrack table to get the original destination.
-			//fmt.Printf("[DEBUG] ServeHTTP() - req: %+v\n", req.Host)
-			if !checkDomain(req.Host) {
-				destination := proxy.DestinationResolver(c)
-				//fmt.Println("[DEBUG] Invalid HTTP host specified. Determining original destination through conntrak:", req.Host, "->", destination)
-				req.Host = destination
-			}
+// Adds or removes a connection from the set which Shutdown() forcibly closes if its context
+// expires before the handlers complete. Both client and upstream connections are tracked.
+func (proxy *ProxyHttpServer) trackConn(c net.Conn, add bool) {
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	if add {
+		if proxy.activeconns == nil {
+			proxy.activeconns = make(map[net.Conn]struct{})
+		}
+		proxy.activeconns[c] = struct{}{}
+	} else {
+		delete(proxy.activeconns, c)
+		delete(proxy.idleconns, c)
+	}
+}
 
-			// If still invalid, we couldn't resolve it. Drop the request.
-			if !checkDomain(req.Host) {
-				fmt.Printf("[ERROR] Failed to determine original destination: %s. Dropping request.\n", req.Host)
-				c.Close()
-				return
-			}
+// Tracks a newly accepted client connection, which Shutdown() closes straight away until
+// markConnActive is called.
+func (proxy *ProxyHttpServer) trackIdleConn(c net.Conn) {
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	if proxy.activeconns == nil {
+		proxy.activeconns = make(map[net.Conn]struct{})
+	}
+	if proxy.idleconns == nil {
+		proxy.idleconns = make(map[net.Conn]struct{})
+	}
+	proxy.activeconns[c] = struct{}{}
+	proxy.idleconns[c] = struct{}{}
+}
 
-			// Empty buffer / no request - drop it.
-			if buf.Len() == 0 {
-				//fmt.Printf("[ERROR] Received zero length request to host: %s. Dropping request.\n", req.Host)
-				c.Close()
-				return
-			}
+// Called once a request has been read from a client connection, so that Shutdown() waits for
+// it to be handled. Returns false if Shutdown() has already closed the connection.
+func (proxy *ProxyHttpServer) markConnActive(c net.Conn) bool {
+	c = netConn(c)
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	delete(proxy.idleconns, c)
+	_, ok := proxy.activeconns[c]
+	return ok || !proxy.shuttingDown()
+}
+
+func (proxy *ProxyHttpServer) closeIdleConns() {
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	for c := range proxy.idleconns {
+		c.Close()
+		delete(proxy.idleconns, c)
+		delete(proxy.activeconns, c)
+	}
+}
+
+func (proxy *ProxyHttpServer) closeActiveConns() {
+	proxy.servemu.Lock()
+	defer proxy.servemu.Unlock()
+	for c := range proxy.activeconns {
+		c.Close()
+		delete(proxy.activeconns, c)
+		delete(proxy.idleconns, c)
+	}
+}
+
+// onceCloseListener wraps a net.Listener, protecting it from multiple Close calls.
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (oc *onceCloseListener) Close() error {
+	oc.once.Do(oc.close)
+	return oc.closeErr
+}
+
+func (oc *onceCloseListener) close() { oc.closeErr = oc.Listener.Close() }
+
+// Reads the first request from a raw HTTP connection and passes it on to HandleHTTPConnection().
+func (proxy *ProxyHttpServer) handleHTTPConnection(c net.Conn) {
+	//log.Printf("[INFO] Incoming HTTP request - source: %s / destination: %s", c.RemoteAddr().String(), c.LocalAddr().String())
+	var buf bytes.Buffer
+	tee := io.TeeReader(c, &buf)
+	connteereader := bufio.NewReader(tee)
+
+	req, err := http.ReadRequest(connteereader)
+
+	// Shutdown() now waits for the request to be handled rather than closing the connection.
+	if !proxy.markConnActive(c) {
+		return
+	}
+
+	if err != nil {
+		// TODO: Try to recover as much information from the original request
+		// as possible so that we can act on headers that might actually be
+		// there (especially referrer and user agent)
+		//fmt.Printf("[DEBUG] ServeHTTP() - Couldn't parse request: %s\nOriginal Request:\n%s\n", err.Error(), string(buf.Bytes()))
+
+		req = &http.Request{
+			Method: "",
+			//URL:	&url.URL{
+			//Host: net.JoinHostPort(Host, "80"),
+			//},
+			Proto:      "http", // assume http, but it's probably not.
+			ProtoMajor: 0,
+			ProtoMinor: 0,
+			Header:     make(http.Header),
+			Body:       nil,
+			Host:       "",
+			//RequestURI: Host,
+		}
+		//isnonhttpprotocol = true
 
-			proxy.HandleHTTPConnection(c, req, &resp, &buf)
-		}(c)
 	}
+
+	// http.ReadRequest() doesn't know where the request came from. With AcceptProxyProtocol set,
+	// this is the client address from the PROXY header rather than that of the load balancer.
+	req.RemoteAddr = c.RemoteAddr().String()
+
+	// To print any local responses (errors) to stdout, uncomment SpyConnection.
+	// This will not print out anything related to forwarded connections.
+	// resp := notsodumbResponseWriter{Conn: &SpyConnection{c}, ResponseHeader: &req.Header}
+
+	resp := notsodumbResponseWriter{Conn: c, ResponseHeader: &req.Header}
+
+	if isDirectRequest(c, req) {
+		proxy.serveNonProxyRequest(c, req)
+		return
+	}
+
+	// Failover Host detection - if we couldn't read the host from the HTTP headers, check the
+	// conntrack table to get the original destination.
+	//fmt.Printf("[DEBUG] ServeHTTP() - req: %+v\n", req.Host)
+	if !checkDomain(req.Host) {
+		destination := proxy.originalDestination(c)
+		//fmt.Println("[DEBUG] Invalid HTTP host specified. Determining original destination through conntrak:", req.Host, "->", destination)
+		req.Host = destination
+	}
+
+	// If still invalid, we couldn't resolve it. Drop the request.
+	if !checkDomain(req.Host) {
+		fmt.Printf("[ERROR] Failed to determine original destination: %s. Dropping request.\n", req.Host)
+		c.Close()
+		return
+	}
+
+	// Empty buffer / no request - drop it.
+	if buf.Len() == 0 {
+		//fmt.Printf("[ERROR] Received zero length request to host: %s. Dropping request.\n", req.Host)
+		c.Close()
+		return
+	}
+
+	proxy.HandleHTTPConnection(c, req, &resp, &buf)
+}
+
+// Reports whether a request was addressed to the proxy itself rather than intercepted on its way
+// to another server: the URL is relative and the Host header names the address the client
+// connected to. Connections accepted through a PROXY protocol header or an iptables TPROXY rule
+// report the client's original destination as their local address, so they are never treated
+// as direct.
+func isDirectRequest(c net.Conn, req *http.Request) bool {
+	if req.Method == "" || req.Method == "CONNECT" || req.URL == nil || req.URL.IsAbs() {
+		return false
+	}
+	local, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+	}
+	if port != strconv.Itoa(local.Port) {
+		return false
+	}
+	if host == "localhost" {
+		if !local.IP.IsLoopback() {
+			return false
+		}
+	} else if ip := net.ParseIP(strings.Trim(host, "[]")); ip == nil || !ip.Equal(local.IP) {
+		return false
+	}
+
+	// Checked last, since reading the socket options takes system calls.
+	_, ok = c.(*proxyProtoConn)
+	return !ok && !isTransparentConn(c)
+}
+
+// Serves a request addressed to the proxy itself with NonProxyHandler, then closes the connection.
+func (proxy *ProxyHttpServer) serveNonProxyRequest(c net.Conn, req *http.Request) {
+	defer c.Close()
+	if proxy.NonProxyHandler == nil {
+		return
+	}
+
+	w := &notsodumbResponseWriter{Conn: c, ResponseHeader: &http.Header{}}
+	proxy.NonProxyHandler.ServeHTTP(w, req)
+	w.Flush()
 }
 
 func ConvertUserAgentToSignature(s string) string {
@@ -360,9 +708,17 @@ func ConvertUserAgentToSignature(s string) string {
 // established. This is mitigated in practice because devices with the browser extension installed handle their
 // own logging.
 func (proxy *ProxyHttpServer) HandleHTTPConnection(c net.Conn, r *http.Request, w http.ResponseWriter, originalrequest *bytes.Buffer) {
+	// The request was parsed from a raw connection, so r.RemoteAddr is only set if the caller did so.
+	if r.RemoteAddr == "" {
+		r.RemoteAddr = c.RemoteAddr().String()
+	}
+
 	ctx := &ProxyCtx{
 		Method:         r.Method,
-		SourceIP:       r.RemoteAddr, // pick it from somewhere else ? have a plugin to override this ?
+		SourceIP:       c.RemoteAddr().String(),
+		ClientAddr:     c.RemoteAddr(),
+		LocalAddr:      c.LocalAddr(),
+		clientConn:     c,
 		Req:            r,
 		ResponseWriter: w,
 		UserData:       make(map[string]string),
@@ -444,6 +800,8 @@ func (proxy *ProxyHttpServer) HandleHTTPConnection(c net.Conn, r *http.Request,
 		//ctx.Req.URL.Scheme = "ws"
 	}
 
+	proxy.classifyDevice(ctx)
+
 	// RLS 2/19/2019 - Anything which is not a CONNECT request will go to DispatchRequestHandlers.
 	// This will now forward the original request without modifying it.
 	if r.Method == "CONNECT" {
@@ -553,293 +911,272 @@ func formatRequest(r *http.Request) string {
 	return strings.Join(request, "\n")
 }
 
-// Given a connection, resolves its original destination by looking it up in the conntrak tables.
-// This is required for non-TLS protocols or for connections initiated by devices which do not
-// send a valid SNI field in the CLIENTHELLO message.
-func resolveconntrackdestination(c net.Conn) string {
-	connections, connerr := conntrack.Flows()
-	if connerr != nil {
-		log.Printf("[ERROR] non-SNI client detected but couldn't read connection table. Dropping connection request. [%v]\n", connerr)
-		return ""
-	}
-
-	var nonSNIHost net.IP
-
-	// Get the source port
-	sourcePort := 0
-	portIndex := strings.IndexRune(c.RemoteAddr().String(), ':')
-
-	if portIndex == -1 {
-		log.Println("[ERROR] non-SNI client detected but there was no source port on the request. Dropping connection request.")
-		return ""
-	} else {
-		sourcePort, _ = strconv.Atoi(c.RemoteAddr().String()[(portIndex + 1):])
+// This function listens for TLS requests on the specified port.
+// It should be called within a goroutine, otherwise it will block until Shutdown() is called.
+func (proxy *ProxyHttpServer) ListenAndServeTLS(httpsAddr string) error {
+	if proxy.shuttingDown() {
+		return ErrProxyClosed
 	}
 
-	if sourcePort == 0 {
-		log.Println("[ERROR] non-SNI client detected but couldn't parse source port on the request. Dropping connection request.")
-		return ""
+	ln, err := net.Listen("tcp", httpsAddr)
+	if err != nil {
+		return fmt.Errorf("error listening for https connections on %s: %v", httpsAddr, err)
 	}
 
-	for _, flow := range connections {
-		if flow.Original.SPort == sourcePort {
-			nonSNIHost = flow.Original.Destination
-		}
-	}
+	return proxy.ServeTLSListener(ln)
+}
 
-	return nonSNIHost.String()
+// ServeTLSListener accepts transparently intercepted TLS (port 443) connections on any
+// net.Listener. It behaves like ServeHTTPListener in every other respect.
+func (proxy *ProxyHttpServer) ServeTLSListener(ln net.Listener) error {
+	return proxy.serve(ln, proxy.handleTLSConnection)
 }
 
-// This function listens for TLS requests on the specified port.
-// It should be called within a goroutine, otherwise it will block forever.
-func (proxy *ProxyHttpServer) ListenAndServeTLS(httpsAddr string) error {
-	ln, err := net.Listen("tcp", httpsAddr)
+// Sniffs the ClientHello on a transparently intercepted TLS connection and dispatches it to
+// the connect handlers as if it were a CONNECT request.
+func (proxy *ProxyHttpServer) handleTLSConnection(c net.Conn) {
+	//log.Printf("[INFO] INCOMING TLS CONNECTION - source: %s / destination: %s", c.RemoteAddr().String(), c.LocalAddr().String())
+	tlsConn, err := vhost.TLS(c)
 
-	if err != nil {
-		log.Fatalf("Error listening for https connections (err 1) - %v", err)
+	// Shutdown() now waits for the connection to be handled rather than closing it.
+	if !proxy.markConnActive(c) {
+		return
 	}
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			log.Printf("Error accepting new connection (err 2) - %v", err)
-			continue
-		}
-		go func(c net.Conn) {
-			atomic.AddInt64(&proxy.openhandlers, 1)
-			defer func() {
-				atomic.AddInt64(&proxy.openhandlers, -1)
-			}()
-
-			//log.Printf("[INFO] INCOMING TLS CONNECTION - source: %s / destination: %s", c.RemoteAddr().String(), c.LocalAddr().String())
-			tlsConn, err := vhost.TLS(c)
 
-			forwardwithoutintercept := false
-			if err != nil {
-				// Honeywell Lynx 5100 (and possibly other devices) send a non-TLS protocol over port 443.
-				//log.Println("[WARN] Non-TLS protocol detected on port 443.")
-				forwardwithoutintercept = true
-			}
+	forwardwithoutintercept := false
+	if err != nil {
+		// Honeywell Lynx 5100 (and possibly other devices) send a non-TLS protocol over port 443.
+		//log.Println("[WARN] Non-TLS protocol detected on port 443.")
+		forwardwithoutintercept = true
+	}
 
-			var Host = tlsConn.Host()
+	var Host = tlsConn.Host()
 
-			//fmt.Println("[DEBUG] ListenAndServeTLS() - ClientHELLO server name/host:", tlsConn.Host())
-			if !checkDomain(Host) {
-				// Non-SNI request handling routine
-				//log.Printf("[DEBUG] Invalid host or non-SNI client detected - host: %s\n", tlsConn.Host())
-				Host = proxy.DestinationResolver(c)
-			}
+	//fmt.Println("[DEBUG] ListenAndServeTLS() - ClientHELLO server name/host:", tlsConn.Host())
+	if !checkDomain(Host) {
+		// Non-SNI request handling routine
+		//log.Printf("[DEBUG] Invalid host or non-SNI client detected - host: %s\n", tlsConn.Host())
+		Host = proxy.originalDestination(c)
+	}
 
-			// If still invalid, we couldn't resolve it. Drop the request.
-			if !checkDomain(Host) {
-				//fmt.Printf("[ERROR] Failed to parse original HTTP host: %s. Dropping request.\n", Host)
-				tlsConn.Close()
-				return
-			}
+	// If still invalid, we couldn't resolve it. Drop the request.
+	if !checkDomain(Host) {
+		//fmt.Printf("[ERROR] Failed to parse original HTTP host: %s. Dropping request.\n", Host)
+		tlsConn.Close()
+		return
+	}
 
-			// Check for local host
-			// TODO: Determine Winston IP address dynamically. For now, we reserve 192.168.102.* for ourselves.
-			if strings.HasPrefix(Host, "192.168.102.") {
-				//log.Printf("[DEBUG] non-SNI attempt at local host. Dropping request: [%s]  non-SNI Host: [%s]\n", Host, nonSNIHost)
-				tlsConn.Close()
-				return
-			}
+	// Drop non-SNI connections to ourselves.
+	if proxy.LocalNetworks.ContainsHost(Host) {
+		//log.Printf("[DEBUG] non-SNI attempt at local host. Dropping request: [%s]  non-SNI Host: [%s]\n", Host, nonSNIHost)
+		tlsConn.Close()
+		return
+	}
 
-			// If we weren't provided with a port, assume 443
-			var hostwithport = Host
-			if strings.IndexRune(Host, ':') == -1 {
-				hostwithport += ":443"
-			}
+	// If we weren't provided with a port, assume 443
+	var hostwithport = Host
+	if strings.IndexRune(Host, ':') == -1 {
+		hostwithport += ":443"
+	}
 
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL: &url.URL{
-					Opaque: Host,
-					Host:   hostwithport,
-				},
-				Host:   Host,
-				Header: make(http.Header),
-			}
-			resp := dumbResponseWriter{tlsConn}
-
-			// Set up a context object for the current request
-			ctx := &ProxyCtx{
-				Method:         connectReq.Method,
-				SourceIP:       connectReq.RemoteAddr, // pick it from somewhere else ? have a plugin to override this ?
-				Req:            connectReq,
-				ResponseWriter: resp,
-				UserData:       make(map[string]string),
-				UserObjects:    make(map[string]interface{}),
-				Session:        atomic.AddInt64(&proxy.sess, 1),
-				Proxy:          proxy,
-				MITMCertConfig: proxy.MITMCertConfig,
-				Tlsfailure:     proxy.Tlsfailure,
-				VerbosityLevel: proxy.VerbosityLevel,
-				DeviceType:     -1,
-				RequestTime:    time.Now(),
-				TunnelRequest:  forwardwithoutintercept,
-				IsSecure:       true,
-			}
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL: &url.URL{
+			Opaque: Host,
+			Host:   hostwithport,
+		},
+		Host:       Host,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	resp := dumbResponseWriter{tlsConn}
 
-			ctx.host = hostwithport
+	// Set up a context object for the current request
+	ctx := &ProxyCtx{
+		Method:         connectReq.Method,
+		SourceIP:       c.RemoteAddr().String(),
+		ClientAddr:     c.RemoteAddr(),
+		LocalAddr:      c.LocalAddr(),
+		clientConn:     c,
+		Req:            connectReq,
+		ResponseWriter: resp,
+		UserData:       make(map[string]string),
+		UserObjects:    make(map[string]interface{}),
+		Session:        atomic.AddInt64(&proxy.sess, 1),
+		Proxy:          proxy,
+		MITMCertConfig: proxy.MITMCertConfig,
+		Tlsfailure:     proxy.Tlsfailure,
+		VerbosityLevel: proxy.VerbosityLevel,
+		DeviceType:     -1,
+		RequestTime:    time.Now(),
+		TunnelRequest:  forwardwithoutintercept,
+		IsSecure:       true,
+	}
 
-			//fmt.Println("[DEBUG] ListenAndServeTLS() - ctx.Host:", ctx.host)
+	ctx.host = hostwithport
 
-			// We've sniffed the SNI record already through the vlshost muxer.
-			// This just sets the flags to avoid throwing warnings.
-			ctx.sniffedTLS = true
-			ctx.sniHost = Host
+	//fmt.Println("[DEBUG] ListenAndServeTLS() - ctx.Host:", ctx.host)
 
-			// TODO: Should caller handle this or should we?
-			// Create a signature string for the accepted ciphers
+	// We've sniffed the SNI record already through the vlshost muxer.
+	// This just sets the flags to avoid throwing warnings.
+	ctx.sniffedTLS = true
+	ctx.sniHost = Host
+	ctx.serverName = tlsConn.Host()
 
-			ctx.CipherSignature = func() string {
-				if tlsConn.ClientHelloMsg != nil && len(tlsConn.ClientHelloMsg.CipherSuites) > 0 {
-					// RLS 10/10/2017 - Expanded signature
-					// Generate a fingerprint for the client. This enables us to whitelist
-					// failed TLS queries on a per-client basis.
-					return GenerateSignature(tlsConn.ClientHelloMsg, false)
-				}
-				return ""
-			}()
+	// TODO: Should caller handle this or should we?
+	// Create a signature string for the accepted ciphers
 
-			// TEST
-			// Set up a shared buffer so the second request can see the original request body
-			//var buf []byte
-			if proxy.Trace != nil {
-				ctx.Trace = proxy.Trace(ctx)
-				if ctx.Trace.Modified {
+	ctx.CipherSignature = func() string {
+		if tlsConn.ClientHelloMsg != nil && len(tlsConn.ClientHelloMsg.CipherSuites) > 0 {
+			// RLS 10/10/2017 - Expanded signature
+			// Generate a fingerprint for the client. This enables us to whitelist
+			// failed TLS queries on a per-client basis.
+			return GenerateSignature(tlsConn.ClientHelloMsg, false)
+		}
+		return ""
+	}()
+	ctx.ClientHello = clientHelloFromVhost(tlsConn.ClientHelloMsg)
+	if ctx.ClientHello != nil {
+		ctx.JA3, _ = ctx.ClientHello.JA3()
+		ctx.JA4 = ctx.ClientHello.JA4()
+	}
+	proxy.classifyDevice(ctx)
 
-					//fmt.Printf("ClientHELLO: \n %+v\n", tlsConn.ClientHelloMsg)
+	// TEST
+	// Set up a shared buffer so the second request can see the original request body
+	//var buf []byte
+	if proxy.Trace != nil {
+		ctx.Trace = proxy.Trace(ctx)
+		if ctx.Trace.Modified {
 
-					setupTrace(ctx, "Modified Request")
-					//fmt.Printf("[DEBUG] Original request location: [%p]\n", ctx.TraceInfo.ReqBody)
-					//ctx.TraceInfo.ReqBody = &buf
-				}
-			}
+			//fmt.Printf("ClientHELLO: \n %+v\n", tlsConn.ClientHelloMsg)
 
-			// Print out TLS CLIENTHELLO message. Useful for inspecting cipher suites.
-			//if ctx.Trace {
-			//	fmt.Printf("[TRACE] CLIENTHELLO [%s] [Vers=%v] =\n%+v\n\n", ctx.CipherSignature, (*tlsConn.ClientHelloMsg).Vers, *tlsConn.ClientHelloMsg)
-			//}
+			setupTrace(ctx, "Modified Request")
+			//fmt.Printf("[DEBUG] Original request location: [%p]\n", ctx.TraceInfo.ReqBody)
+			//ctx.TraceInfo.ReqBody = &buf
+		}
+	}
 
-			//fmt.Println("[DEBUG] ListenAndServeTLS() - request host:", ctx.host, ctx.IsSecure)
+	// Print out TLS CLIENTHELLO message. Useful for inspecting cipher suites.
+	//if ctx.Trace {
+	//	fmt.Printf("[TRACE] CLIENTHELLO [%s] [Vers=%v] =\n%+v\n\n", ctx.CipherSignature, (*tlsConn.ClientHelloMsg).Vers, *tlsConn.ClientHelloMsg)
+	//}
 
-			proxy.dispatchConnectHandlers(ctx)
+	//fmt.Println("[DEBUG] ListenAndServeTLS() - request host:", ctx.host, ctx.IsSecure)
 
-			// If tracing, run the same request but skip any filtering.
-			/*if ctx.Trace.Unmodified {
+	proxy.dispatchConnectHandlers(ctx)
 
-				// Wait a little while for the original request to complete
-				// TODO: Use a channel for this. Also send back original request body???
-				time.Sleep(10 * time.Second)
+	// If tracing, run the same request but skip any filtering.
+	/*if ctx.Trace.Unmodified {
 
-				//fmt.Printf("[DEBUG] original http.Request 1 - [%p] (%d)\n%s\n", ctx.TraceInfo.ReqBody, len(*ctx.TraceInfo.ReqBody), string(*ctx.TraceInfo.ReqBody))
+		// Wait a little while for the original request to complete
+		// TODO: Use a channel for this. Also send back original request body???
+		time.Sleep(10 * time.Second)
 
-				//fmt.Printf("[TRACE] Running parallel https request to %s\n", ctx.Req.URL)
-				// Create a bidirectional, in-memory connection with fake client. This enables us to spoof
-				// the original client and utilize the same logic that the first request did.
-				var pipe *fasthttputil.PipeConns
-				pipe = fasthttputil.NewPipeConns()
+		//fmt.Printf("[DEBUG] original http.Request 1 - [%p] (%d)\n%s\n", ctx.TraceInfo.ReqBody, len(*ctx.TraceInfo.ReqBody), string(*ctx.TraceInfo.ReqBody))
 
-				// Create a mock client
-				fakeclient := http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: &tls.Config{
-							InsecureSkipVerify: true,
-						},
-						DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-							return pipe.Conn1(), nil
-						},
-					},
-				}
+		//fmt.Printf("[TRACE] Running parallel https request to %s\n", ctx.Req.URL)
+		// Create a bidirectional, in-memory connection with fake client. This enables us to spoof
+		// the original client and utilize the same logic that the first request did.
+		var pipe *fasthttputil.PipeConns
+		pipe = fasthttputil.NewPipeConns()
 
-				// Make the request
-				Url := ctx.Req.URL.String()
-				go func() {
-					request, err := http.NewRequest(connectReq.Method, Url, nil)
+		// Create a mock client
+		fakeclient := http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+				DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+					return pipe.Conn1(), nil
+				},
+			},
+		}
 
-					//fmt.Printf("[DEBUG] proxy.go request: %+v\n\n", request)
+		// Make the request
+		Url := ctx.Req.URL.String()
+		go func() {
+			request, err := http.NewRequest(connectReq.Method, Url, nil)
 
-					for k, v := range ctx.TraceInfo.originalheaders {
-						//fmt.Printf("Copy header: %s : %s\n", k, v)
-						request.Header.Set(k, v)
-					}
+			//fmt.Printf("[DEBUG] proxy.go request: %+v\n\n", request)
 
-					fakeresp, err := fakeclient.Do(request)
-					if err != nil {
-						fmt.Printf("[TRACE] Fake client didn't receive a response. err=%+v\n", err)
-						return
-					}
+			for k, v := range ctx.TraceInfo.originalheaders {
+				//fmt.Printf("Copy header: %s : %s\n", k, v)
+				request.Header.Set(k, v)
+			}
 
-					defer fakeresp.Body.Close()
+			fakeresp, err := fakeclient.Do(request)
+			if err != nil {
+				fmt.Printf("[TRACE] Fake client didn't receive a response. err=%+v\n", err)
+				return
+			}
 
-					body, err := ioutil.ReadAll(fakeresp.Body)
-					if err != nil {
-						fmt.Printf("[TRACE] Error while reading body. %+v\n", err)
-						return
-					}
-					// Process the response and close. We wait one second so the response body
-					// occurs after the headers.
-					time.Sleep(time.Second)
-					fmt.Printf("[TRACE] Unmodified Response Body [%d bytes]: %+v\n", len(body), string(body))
+			defer fakeresp.Body.Close()
 
+			body, err := ioutil.ReadAll(fakeresp.Body)
+			if err != nil {
+				fmt.Printf("[TRACE] Error while reading body. %+v\n", err)
+				return
+			}
+			// Process the response and close. We wait one second so the response body
+			// occurs after the headers.
+			time.Sleep(time.Second)
+			fmt.Printf("[TRACE] Unmodified Response Body [%d bytes]: %+v\n", len(body), string(body))
 
-				}()
 
-				// Handshakes with our fake client. The connection should already be open.
-				tlsConnClient, err := vhost.TLS(pipe.Conn2())
-				if err != nil {
-					fmt.Printf("[TRACE] Error - server couldn't open pipe to fake client. Unmodified https response not available. $+v\n", err)
-				} else {
-					connectReqCopy := &http.Request{
-						Method: "CONNECT",
-						URL: connectReq.URL,
-						Host:   Host,
-						Header: make(http.Header),
-					}
-					respClient := dumbResponseWriter{tlsConnClient}
-
-					// Duplicate the request and send it through as whitelisted. This will show us the original
-					// information without any modification.
-					ctxOrig := &ProxyCtx{
-						Method:         connectReqCopy.Method,
-						SourceIP:       connectReqCopy.RemoteAddr, // pick it from somewhere else ? have a plugin to override this ?
-						Req:            connectReqCopy,
-						ResponseWriter: respClient,
-						UserData:       make(map[string]string),
-						UserObjects:    make(map[string]interface{}),
-						Session:        atomic.AddInt64(&proxy.sess, 1),
-						Proxy:          proxy,
-						MITMCertConfig: proxy.MITMCertConfig,
-						Tlsfailure:        proxy.Tlsfailure,
-						VerbosityLevel: proxy.VerbosityLevel,
-						DeviceType: -1,
-						CipherSignature:        ctx.CipherSignature,
-						sniffedTLS:             ctx.sniffedTLS,
-						sniHost:                ctx.sniHost,
-						host:			ctx.host,
-						Trace:                  ctx.Trace,
-						SkipRequestHandler:     true,
-						SkipResponseHandler:    true,
-					}
+		}()
 
-					setupTrace(ctxOrig, "Unmodified Request")
+		// Handshakes with our fake client. The connection should already be open.
+		tlsConnClient, err := vhost.TLS(pipe.Conn2())
+		if err != nil {
+			fmt.Printf("[TRACE] Error - server couldn't open pipe to fake client. Unmodified https response not available. $+v\n", err)
+		} else {
+			connectReqCopy := &http.Request{
+				Method: "CONNECT",
+				URL: connectReq.URL,
+				Host:   Host,
+				Header: make(http.Header),
+			}
+			respClient := dumbResponseWriter{tlsConnClient}
+
+			// Duplicate the request and send it through as whitelisted. This will show us the original
+			// information without any modification.
+			ctxOrig := &ProxyCtx{
+				Method:         connectReqCopy.Method,
+				SourceIP:       connectReqCopy.RemoteAddr, // pick it from somewhere else ? have a plugin to override this ?
+				Req:            connectReqCopy,
+				ResponseWriter: respClient,
+				UserData:       make(map[string]string),
+				UserObjects:    make(map[string]interface{}),
+				Session:        atomic.AddInt64(&proxy.sess, 1),
+				Proxy:          proxy,
+				MITMCertConfig: proxy.MITMCertConfig,
+				Tlsfailure:        proxy.Tlsfailure,
+				VerbosityLevel: proxy.VerbosityLevel,
+				DeviceType: -1,
+				CipherSignature:        ctx.CipherSignature,
+				sniffedTLS:             ctx.sniffedTLS,
+				sniHost:                ctx.sniHost,
+				host:			ctx.host,
+				Trace:                  ctx.Trace,
+				SkipRequestHandler:     true,
+				SkipResponseHandler:    true,
+			}
 
-					// Copy the body and method from the original request to the one
-					ctxOrig.TraceInfo.ReqBody = ctx.TraceInfo.ReqBody
-					ctxOrig.TraceInfo.Method = ctx.TraceInfo.Method
+			setupTrace(ctxOrig, "Unmodified Request")
 
-					//fmt.Printf("[DEBUG] request body after tracesetup: [%p] %s\n", ctxOrig.TraceInfo.ReqBody, string(*ctxOrig.TraceInfo.ReqBody))
+			// Copy the body and method from the original request to the one
+			ctxOrig.TraceInfo.ReqBody = ctx.TraceInfo.ReqBody
+			ctxOrig.TraceInfo.Method = ctx.TraceInfo.Method
 
-					//fmt.Printf("[TRACE] Dispatching connect handlers to %+v\n", ctxOrig.Req.URL)
-					proxy.dispatchConnectHandlers(ctxOrig)
+			//fmt.Printf("[DEBUG] request body after tracesetup: [%p] %s\n", ctxOrig.TraceInfo.ReqBody, string(*ctxOrig.TraceInfo.ReqBody))
 
+			//fmt.Printf("[TRACE] Dispatching connect handlers to %+v\n", ctxOrig.Req.URL)
+			proxy.dispatchConnectHandlers(ctxOrig)
 
-				}
-			}*/
 
-		}(c)
-	}
+		}
+	}*/
 }
 
 func GenerateSignature(h *vhost.ClientHelloMsg, debug bool) string {
@@ -1,6 +1,8 @@
 package goproxy_test
 
 import (
+	"context"
+	"encoding/json"
 	//"bufio"
 	//"bytes"
 	"crypto/tls"
@@ -825,6 +827,144 @@ func TestHttpsBadSNI(t *testing.T) {
 
 }
 
+func TestClientAddr(t *testing.T) {
+	Convey("Client and local addresses are available to HTTP handlers", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		var sourceIP string
+		var clientAddr, localAddr net.Addr
+		proxy.HandleRequestFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			sourceIP, clientAddr, localAddr = ctx.SourceIP, ctx.ClientAddr, ctx.LocalAddr
+			return goproxy.NEXT
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		request, err := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		So(err, ShouldEqual, nil)
+		request.Write(conn)
+		So(parseResponseBody(conn), ShouldContainSubstring, "bobo")
+
+		So(sourceIP, ShouldEqual, conn.LocalAddr().String())
+		So(clientAddr.String(), ShouldEqual, conn.LocalAddr().String())
+		So(localAddr.String(), ShouldEqual, ln.Addr().String())
+	})
+
+	Convey("Client and local addresses are available to TLS connect handlers", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		var sourceIP string
+		var clientAddr, localAddr net.Addr
+		proxy.HandleConnectFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			sourceIP, clientAddr, localAddr = ctx.SourceIP, ctx.ClientAddr, ctx.LocalAddr
+			return goproxy.NEXT
+		})
+
+		servername := strings.TrimPrefix(srvhttps.URL, "https://")
+		proxy.DestinationResolver = func(c net.Conn) string {
+			return servername
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeTLSListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "*.badsni.com"})
+		So(tlsConn.Handshake(), ShouldEqual, nil)
+
+		So(sourceIP, ShouldEqual, conn.LocalAddr().String())
+		So(clientAddr.String(), ShouldEqual, conn.LocalAddr().String())
+		So(localAddr.String(), ShouldEqual, ln.Addr().String())
+	})
+}
+
+func TestHandlerPanic(t *testing.T) {
+	Convey("A panicking request handler is reported and the client gets an error page", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		errs := make(chan *goproxy.HandlerError, 1)
+		proxy.OnHandlerError = func(ctx *goproxy.ProxyCtx, err *goproxy.HandlerError) {
+			errs <- err
+		}
+		proxy.HandleRequestNamed(goproxy.HandlerOptions{Name: "buggy"}, goproxy.HandlerFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			var m map[string]string
+			m["boom"] = "boom"
+			return goproxy.NEXT
+		}))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		request, err := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		So(err, ShouldEqual, nil)
+		request.Write(conn)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), request)
+		So(err, ShouldEqual, nil)
+		So(resp.StatusCode, ShouldEqual, 502)
+
+		herr := <-errs
+		So(herr.Handler, ShouldEqual, "buggy")
+		So(herr.Stage, ShouldEqual, "request")
+		So(herr.Panic, ShouldNotEqual, nil)
+		So(string(herr.Stack), ShouldContainSubstring, "TestHandlerPanic")
+
+		// The proxy is still serving requests.
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()})}}
+		proxy.RemoveHandlerGroup("")
+		r := string(getOrFail(srv.URL+"/bobo", client, t))
+		So(r, ShouldEqual, "bobo")
+	})
+
+	Convey("A connect handler returning an invalid Next value closes the connection", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		errs := make(chan *goproxy.HandlerError, 1)
+		proxy.OnHandlerError = func(ctx *goproxy.ProxyCtx, err *goproxy.HandlerError) {
+			errs <- err
+		}
+		proxy.HandleConnectFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			return goproxy.Next(99)
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeTLSListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"})
+		So(tlsConn.Handshake(), ShouldNotEqual, nil)
+
+		herr := <-errs
+		So(herr.Stage, ShouldEqual, "connect")
+		So(herr.Next, ShouldEqual, goproxy.Next(99))
+		So(herr.Panic, ShouldEqual, nil)
+		So(herr.Host, ShouldEqual, "example.com:443")
+	})
+}
+
 // Confirms that the API can listen and respond to requests
 func TestAPIHook(t *testing.T) {
 	Convey("Requests can be intercepted by a custom handler", t, func() {
@@ -872,6 +1012,402 @@ func TestAPIHook(t *testing.T) {
 	})
 }
 
+func TestShutdown(t *testing.T) {
+	Convey("Shutdown stops accepting connections and returns once handlers complete", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+
+		served := make(chan error, 1)
+		go func() { served <- proxy.Serve(ln) }()
+
+		// A request which completes before shutdown doesn't hold it up.
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()}), DisableKeepAlives: true}}
+		r := string(getOrFail(srv.URL+"/bobo", client, t))
+		So(r, ShouldEqual, "bobo")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		So(proxy.Shutdown(ctx), ShouldEqual, nil)
+		So(<-served, ShouldEqual, goproxy.ErrProxyClosed)
+
+		_, err = net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldNotEqual, nil)
+		So(proxy.ListenAndServe("127.0.0.1:0"), ShouldEqual, goproxy.ErrProxyClosed)
+	})
+
+	Convey("Shutdown closes connections which haven't sent a request straight away", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+
+		served := make(chan error, 1)
+		go func() { served <- proxy.Serve(ln) }()
+
+		// Open a connection but never send a request, so the handler blocks reading it.
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		So(proxy.Shutdown(ctx), ShouldEqual, nil)
+		So(time.Since(start) < time.Second, ShouldBeTrue)
+		So(<-served, ShouldEqual, goproxy.ErrProxyClosed)
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		So(err, ShouldEqual, io.EOF)
+	})
+
+	Convey("Shutdown closes active connections when its context expires", t, func() {
+		// An upstream server which never responds.
+		upstream, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		defer upstream.Close()
+		go func() {
+			for {
+				c, err := upstream.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+
+		proxy := goproxy.NewProxyHttpServer()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+
+		served := make(chan error, 1)
+		go func() { served <- proxy.Serve(ln) }()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Addr(), upstream.Addr())
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		So(proxy.Shutdown(ctx) == context.DeadlineExceeded, ShouldBeTrue)
+		So(<-served, ShouldEqual, goproxy.ErrProxyClosed)
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = ioutil.ReadAll(conn)
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestMultipleListeners(t *testing.T) {
+	Convey("A single proxy can serve several caller-supplied listeners", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		var addrs []string
+		served := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldEqual, nil)
+			addrs = append(addrs, ln.Addr().String())
+			go func() { served <- proxy.ServeHTTPListener(ln) }()
+		}
+
+		for _, addr := range addrs {
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr}), DisableKeepAlives: true}}
+			r := string(getOrFail(srv.URL+"/bobo", client, t))
+			So(r, ShouldEqual, "bobo")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		So(proxy.Shutdown(ctx), ShouldEqual, nil)
+		for range addrs {
+			So(<-served, ShouldEqual, goproxy.ErrProxyClosed)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Forwarded and rejected requests are exported as OpenMetrics", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.HandleRequestNamed(goproxy.HandlerOptions{Name: "blocker"}, goproxy.HandlerFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			if strings.HasSuffix(ctx.Req.URL.Path, "/blocked") {
+				return goproxy.REJECT
+			}
+			return goproxy.NEXT
+		}))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()}), DisableKeepAlives: true}}
+		So(string(getOrFail(srv.URL+"/bobo", client, t)), ShouldEqual, "bobo")
+		getOrFail(srv.URL+"/blocked", client, t)
+
+		// Requests which can't be forwarded aren't counted as allowed.
+		closed, err := net.Listen("tcp", "127.0.0.2:0")
+		So(err, ShouldEqual, nil)
+		closed.Close()
+		if resp, err := client.Get("http://" + closed.Addr().String() + "/bobo"); err == nil {
+			resp.Body.Close()
+		}
+
+		w := httptest.NewRecorder()
+		proxy.Metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+
+		So(w.Header().Get("Content-Type"), ShouldStartWith, "application/openmetrics-text")
+		So(body, ShouldContainSubstring, `goproxy_requests_total{decision="allowed",host="127.0.0.1"`)
+		So(body, ShouldContainSubstring, `goproxy_requests_total{decision="blocked",host="127.0.0.1"`)
+		So(body, ShouldNotContainSubstring, `host="127.0.0.2"`)
+		So(body, ShouldContainSubstring, "goproxy_upstream_ttfb_seconds_count 1\n")
+		So(body, ShouldContainSubstring, "goproxy_dial_duration_seconds_count 1\n")
+		So(body, ShouldContainSubstring, `goproxy_handler_calls_total{stage="request",handler="blocker"} 3`)
+		So(body, ShouldContainSubstring, `goproxy_handler_results_total{stage="request",handler="blocker",next="REJECT"} 1`)
+		So(body, ShouldEndWith, "# EOF\n")
+	})
+}
+
+func TestAdminAPI(t *testing.T) {
+	Convey("The admin API lists and kills tunnels", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.NonProxyHandler = goproxy.NewAdminHandler(proxy, "secret")
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		admin := func(method, path, token string) (int, string) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			So(err, ShouldEqual, nil)
+			defer conn.Close()
+
+			req, _ := http.NewRequest(method, "http://"+ln.Addr().String()+path, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			req.Write(conn)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+
+		status, _ := admin("GET", "/tunnels", "")
+		So(status, ShouldEqual, 401)
+		status, _ = admin("GET", "/tunnels", "wrong")
+		So(status, ShouldEqual, 401)
+		status, body := admin("GET", "/tunnels", "secret")
+		So(status, ShouldEqual, 200)
+		So(body, ShouldEqual, "[]\n")
+
+		// Keep a tunnel open after the first request.
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+		request, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		request.Write(conn)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, request)
+		So(err, ShouldEqual, nil)
+		ioutil.ReadAll(resp.Body)
+
+		var tunnels []struct {
+			Session   int64  `json:"session"`
+			Host      string `json:"host"`
+			Client    string `json:"client"`
+			BytesUp   uint64 `json:"bytes_up"`
+			BytesDown uint64 `json:"bytes_down"`
+		}
+		status, body = admin("GET", "/tunnels", "secret")
+		So(status, ShouldEqual, 200)
+		So(json.Unmarshal([]byte(body), &tunnels), ShouldEqual, nil)
+		So(len(tunnels), ShouldEqual, 1)
+		So(tunnels[0].Host, ShouldEqual, strings.TrimPrefix(srv.URL, "http://"))
+		So(tunnels[0].Client, ShouldEqual, conn.LocalAddr().String())
+		So(tunnels[0].BytesUp, ShouldBeGreaterThan, 0)
+		So(tunnels[0].BytesDown, ShouldBeGreaterThan, 0)
+
+		status, _ = admin("GET", fmt.Sprintf("/tunnels/kill?session=%d", tunnels[0].Session), "secret")
+		So(status, ShouldEqual, 405)
+		status, _ = admin("POST", fmt.Sprintf("/tunnels/kill?session=%d", tunnels[0].Session), "secret")
+		So(status, ShouldEqual, 200)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = reader.ReadByte()
+		So(err, ShouldEqual, io.EOF)
+
+		status, _ = admin("POST", fmt.Sprintf("/tunnels/kill?session=%d", tunnels[0].Session), "secret")
+		So(status, ShouldEqual, 404)
+		status, _ = admin("POST", "/trace", "secret")
+		So(status, ShouldEqual, 501)
+	})
+}
+
+func TestTunnelRegistry(t *testing.T) {
+	Convey("Tunnels report their totals when they close", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		servername := strings.TrimPrefix(srvhttps.URL, "https://")
+		proxy.DestinationResolver = func(c net.Conn) string {
+			return servername
+		}
+
+		closed := make(chan goproxy.TunnelInfo, 1)
+		proxy.OnTunnelClosed = func(ctx *goproxy.ProxyCtx, tunnel goproxy.TunnelInfo) {
+			closed <- tunnel
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeTLSListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "*.badsni.com"})
+		So(tlsConn.Handshake(), ShouldEqual, nil)
+
+		request, _ := http.NewRequest("GET", srvhttps.URL+"/bobo", nil)
+		request.Write(tlsConn)
+		So(parseResponseBody(tlsConn), ShouldContainSubstring, "bobo")
+
+		tunnels := proxy.Tunnels()
+		So(len(tunnels), ShouldEqual, 1)
+		So(tunnels[0].Host, ShouldEqual, servername)
+		So(tunnels[0].SNI, ShouldEqual, "*.badsni.com")
+		So(tunnels[0].Client, ShouldEqual, conn.LocalAddr().String())
+		So(tunnels[0].CipherSignature, ShouldNotEqual, "")
+		So(tunnels[0].End.IsZero(), ShouldBeTrue)
+
+		tlsConn.Close()
+		var tunnel goproxy.TunnelInfo
+		select {
+		case tunnel = <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnTunnelClosed wasn't called")
+		}
+
+		So(tunnel.Session, ShouldEqual, tunnels[0].Session)
+		So(tunnel.End.IsZero(), ShouldBeFalse)
+		So(tunnel.LastActivity.After(tunnel.Start), ShouldBeTrue)
+		So(tunnel.BytesUp, ShouldBeGreaterThanOrEqualTo, tunnels[0].BytesUp)
+		So(tunnel.BytesDown, ShouldBeGreaterThanOrEqualTo, tunnels[0].BytesDown)
+		So(tunnel.BytesDown, ShouldBeGreaterThan, 0)
+		So(len(proxy.Tunnels()), ShouldEqual, 0)
+	})
+}
+
+func TestConnLimits(t *testing.T) {
+	Convey("Connections over the per-IP limit are dropped and counted", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.ConnLimits = goproxy.ConnLimits{MaxConnsPerIP: 1}
+
+		servername := strings.TrimPrefix(srvhttps.URL, "https://")
+		proxy.DestinationResolver = func(c net.Conn) string {
+			return servername
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeTLSListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "*.badsni.com"})
+		So(tlsConn.Handshake(), ShouldEqual, nil)
+
+		// The first connection is still open, so the second is closed without being read.
+		second, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer second.Close()
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = second.Read(make([]byte, 1))
+		So(err, ShouldNotEqual, nil)
+		if ne, ok := err.(net.Error); ok {
+			So(ne.Timeout(), ShouldBeFalse)
+		}
+
+		rec := httptest.NewRecorder()
+		proxy.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(rec.Body.String(), ShouldContainSubstring, `goproxy_rejected_connections_total{reason="max_conns_per_ip"} 1`)
+
+		request, _ := http.NewRequest("GET", srvhttps.URL+"/bobo", nil)
+		request.Write(tlsConn)
+		So(parseResponseBody(tlsConn), ShouldContainSubstring, "bobo")
+	})
+}
+
+func TestClientHello(t *testing.T) {
+	Convey("Connect handlers can inspect the ClientHello", t, func() {
+		proxy := goproxy.NewProxyHttpServer()
+
+		servername := strings.TrimPrefix(srvhttps.URL, "https://")
+		proxy.DestinationResolver = func(c net.Conn) string {
+			return servername
+		}
+
+		hellos := make(chan *goproxy.ClientHello, 2)
+		proxy.HandleConnectFunc(func(ctx *goproxy.ProxyCtx) goproxy.Next {
+			hellos <- ctx.ClientHello
+			if ctx.ClientHello == nil || ctx.ClientHello.MaxVersion() < tls.VersionTLS13 {
+				return goproxy.REJECT
+			}
+			return goproxy.NEXT
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeTLSListener(ln)
+		defer ln.Close()
+
+		dial := func(config *tls.Config) (*tls.Conn, error) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			tlsConn := tls.Client(conn, config)
+			return tlsConn, tlsConn.Handshake()
+		}
+
+		tlsConn, err := dial(&tls.Config{InsecureSkipVerify: true, ServerName: "*.badsni.com", NextProtos: []string{"h2", "http/1.1"}})
+		So(err, ShouldEqual, nil)
+		defer tlsConn.Close()
+
+		hello := <-hellos
+		So(hello, ShouldNotBeNil)
+		So(hello.ServerName(), ShouldEqual, "*.badsni.com")
+		So(hello.ALPNProtocols(), ShouldResemble, []string{"h2", "http/1.1"})
+		So(hello.OffersALPN("h2"), ShouldBeTrue)
+		So(hello.SupportedVersions(), ShouldContain, uint16(tls.VersionTLS13))
+		So(len(hello.KeyShareGroups()), ShouldBeGreaterThan, 0)
+		So(len(hello.SignatureAlgorithms()), ShouldBeGreaterThan, 0)
+
+		legacy, err := dial(&tls.Config{InsecureSkipVerify: true, ServerName: "*.badsni.com", MaxVersion: tls.VersionTLS12})
+		So(err, ShouldNotEqual, nil)
+		if legacy != nil {
+			legacy.Close()
+		}
+		hello = <-hellos
+		So(hello.MaxVersion(), ShouldEqual, uint16(tls.VersionTLS12))
+		So(hello.SupportedVersions(), ShouldNotContain, uint16(tls.VersionTLS13))
+	})
+}
+
 var upgrader = websocket.Upgrader{}
 
 // Caller should send a listener to eavesdrop on requests
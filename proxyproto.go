@@ -0,0 +1,323 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol support (http://www.haproxy.org/download/2.0/doc/proxy-protocol.txt).
+//
+// When the proxy sits behind HAProxy or a load balancer, the socket only tells us the address
+// of the balancer. The balancer prepends a PROXY header to each connection which carries the
+// address of the real client and the address it originally connected to.
+
+// ErrNoProxyProtocolHeader is returned when AcceptProxyProtocol is set and a connection does
+// not begin with a PROXY protocol header.
+var ErrNoProxyProtocolHeader = errors.New("goproxy: missing PROXY protocol header")
+
+// How long a new connection has to send its PROXY protocol header before it is dropped.
+const proxyProtocolHeaderTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// The longest possible v1 header, including the CRLF.
+	proxyProtocolV1MaxLength = 107
+
+	proxyProtocolV2CmdLocal = 0x0
+	proxyProtocolV2CmdProxy = 0x1
+
+	proxyProtocolV2FamTCP4 = 0x11
+	proxyProtocolV2FamTCP6 = 0x21
+)
+
+// ProxyProtocolHeader holds the addresses carried by a PROXY protocol header. Source and
+// Destination are nil if the sender didn't know them (v1 UNKNOWN, or a v2 LOCAL command such
+// as a load balancer health check), in which case the socket addresses should be used.
+type ProxyProtocolHeader struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Format serializes the header in the wire format of h.Version (1 or 2).
+func (h *ProxyProtocolHeader) Format() []byte {
+	if h.Version == 2 {
+		return h.formatV2()
+	}
+	return h.formatV1()
+}
+
+func (h *ProxyProtocolHeader) formatV1() []byte {
+	if h.Source == nil || h.Destination == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto, src, dst := "TCP4", h.Source.IP.String(), h.Destination.IP.String()
+	if h.Source.IP.To4() == nil || h.Destination.IP.To4() == nil {
+		// Both addresses must belong to the protocol's family, so an IPv4 address paired with
+		// an IPv6 one is sent as an IPv4-mapped IPv6 address.
+		proto, src, dst = "TCP6", ipv6String(h.Source.IP), ipv6String(h.Destination.IP)
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src, dst, h.Source.Port, h.Destination.Port))
+}
+
+// Formats ip as an IPv6 address. net.IP.String() prints IPv4-mapped addresses in dotted form.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *ProxyProtocolHeader) formatV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+
+	if h.Source == nil || h.Destination == nil {
+		buf.Write([]byte{0x20 | proxyProtocolV2CmdLocal, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var src, dst net.IP
+	var fam byte
+	if src, dst = h.Source.IP.To4(), h.Destination.IP.To4(); src != nil && dst != nil {
+		fam = proxyProtocolV2FamTCP4
+	} else {
+		src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+		fam = proxyProtocolV2FamTCP6
+	}
+
+	buf.Write([]byte{0x20 | proxyProtocolV2CmdProxy, fam})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(src)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(h.Destination.Port))
+	return buf.Bytes()
+}
+
+// Reads a v1 or v2 PROXY protocol header from the start of r. Returns ErrNoProxyProtocolHeader
+// if r doesn't start with one.
+func readProxyProtocolHeader(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	// Both versions are at least 12 bytes long: "PROXY UNKNOWN\r\n" and the v2 signature.
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, ErrNoProxyProtocolHeader
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("goproxy: PROXY protocol v1 header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("goproxy: PROXY protocol v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyProtocolHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("goproxy: malformed PROXY protocol v1 header: %q", line)
+	}
+
+	var err error
+	if h.Source, err = parseProxyProtocolV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseProxyProtocolV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseProxyProtocolV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("goproxy: invalid address in PROXY protocol v1 header: %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("goproxy: invalid port in PROXY protocol v1 header: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("goproxy: unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0f
+	fam := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	// The address block is followed by optional TLVs, which we skip along with it.
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyProtocolHeader{Version: 2}
+	switch cmd {
+	case proxyProtocolV2CmdLocal:
+		return h, nil
+	case proxyProtocolV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("goproxy: unsupported PROXY protocol v2 command %d", cmd)
+	}
+
+	var iplen int
+	switch fam {
+	case proxyProtocolV2FamTCP4:
+		iplen = net.IPv4len
+	case proxyProtocolV2FamTCP6:
+		iplen = net.IPv6len
+	default:
+		// UDP and unix sockets aren't meaningful to us. Fall back to the socket addresses.
+		return h, nil
+	}
+
+	if len(payload) < 2*iplen+4 {
+		return nil, errors.New("goproxy: truncated PROXY protocol v2 address block")
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:iplen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*iplen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[iplen : 2*iplen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*iplen+2:])),
+	}
+	return h, nil
+}
+
+// proxyProtoConn is a connection which started with a PROXY protocol header. RemoteAddr() and
+// LocalAddr() report the addresses from the header instead of those of the load balancer.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *ProxyProtocolHeader
+}
+
+// Reads the PROXY protocol header from c. The header must arrive within timeout.
+func newProxyProtoConn(c net.Conn, timeout time.Duration) (*proxyProtoConn, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(c)
+	h, err := readProxyProtocolHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: r, header: h}, nil
+}
+
+// NetConn returns the connection the PROXY header was read from, whose socket options carry
+// the destination when the header doesn't (v1 UNKNOWN or v2 LOCAL).
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Returns the original destination of an intercepted connection. A PROXY protocol header takes
+// precedence over the DestinationResolver, which would only see the load balancer's connection.
+func (proxy *ProxyHttpServer) originalDestination(c net.Conn) string {
+	if pc, ok := c.(*proxyProtoConn); ok && pc.header.Destination != nil {
+		return pc.header.Destination.String()
+	}
+	if proxy.DestinationResolver == nil {
+		return ""
+	}
+	return proxy.DestinationResolver(c)
+}
+
+// Default DestinationResolver.
+func (proxy *ProxyHttpServer) resolveDestination(c net.Conn) string {
+	if proxy.OriginalDestinationResolver == nil {
+		return ""
+	}
+	return proxy.OriginalDestinationResolver.ResolveDestination(c)
+}
+
+type proxyProtocolKey struct{}
+
+// Returns a dial context carrying the addresses of the client connection, which
+// connectDialContext() announces upstream if SendProxyProtocol is set.
+func (ctx *ProxyCtx) proxyProtocolContext(parent context.Context) context.Context {
+	if ctx.Proxy.SendProxyProtocol == 0 || ctx.Conn == nil {
+		return parent
+	}
+
+	h := &ProxyProtocolHeader{Version: ctx.Proxy.SendProxyProtocol}
+	src, srcok := ctx.Conn.RemoteAddr().(*net.TCPAddr)
+	dst, dstok := ctx.Conn.LocalAddr().(*net.TCPAddr)
+	if srcok && dstok {
+		h.Source, h.Destination = src, dst
+	}
+	return context.WithValue(parent, proxyProtocolKey{}, h)
+}
+
+// Writes the PROXY protocol header attached by proxyProtocolContext(), if any, to a newly
+// dialed upstream connection.
+func writeProxyProtocolHeader(ctx context.Context, c net.Conn) error {
+	h, ok := ctx.Value(proxyProtocolKey{}).(*ProxyProtocolHeader)
+	if !ok {
+		return nil
+	}
+	_, err := c.Write(h.Format())
+	return err
+}
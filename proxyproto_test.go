@@ -0,0 +1,207 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProxyProtocolParse(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5555}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		name    string
+		header  []byte
+		src     string
+		dst     string
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 10.1.2.3 192.168.1.10 5555 443\r\n"), "10.1.2.3:5555", "192.168.1.10:443", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n"), "[2001:db8::1]:5555", "[2001:db8::2]:443", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 bad address", []byte("PROXY TCP4 10.1.2 192.168.1.10 5555 443\r\n"), "", "", true},
+		{"v1 bad port", []byte("PROXY TCP4 10.1.2.3 192.168.1.10 5555 70000\r\n"), "", "", true},
+		{"v1 missing CR", []byte("PROXY TCP4 10.1.2.3 192.168.1.10 5555 443\n"), "", "", true},
+		{"v2 tcp4", (&ProxyProtocolHeader{Version: 2, Source: src, Destination: dst}).Format(), "10.1.2.3:5555", "192.168.1.10:443", false},
+		{"v2 tcp6", (&ProxyProtocolHeader{Version: 2, Source: src6, Destination: dst6}).Format(), "[2001:db8::1]:5555", "[2001:db8::2]:443", false},
+		{"v2 local", (&ProxyProtocolHeader{Version: 2}).Format(), "", "", false},
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.header, "payload"...)))
+			h, err := readProxyProtocolHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got header %+v", h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var gotsrc, gotdst string
+			if h.Source != nil {
+				gotsrc, gotdst = h.Source.String(), h.Destination.String()
+			}
+			if gotsrc != tt.src || gotdst != tt.dst {
+				t.Errorf("got %s -> %s, want %s -> %s", gotsrc, gotdst, tt.src, tt.dst)
+			}
+
+			// The payload following the header must be left unread.
+			rest, _ := r.ReadString(0)
+			if rest != "payload" {
+				t.Errorf("header consumed too much: %q left over", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolFormatMixedFamilies(t *testing.T) {
+	h := &ProxyProtocolHeader{
+		Version:     1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+	}
+	want := "PROXY TCP6 ::ffff:10.1.2.3 2001:db8::2 5555 443\r\n"
+	if got := string(h.Format()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	parsed, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(h.Format())))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !parsed.Source.IP.Equal(h.Source.IP) || !parsed.Destination.IP.Equal(h.Destination.IP) {
+		t.Errorf("got %s -> %s, want %s -> %s", parsed.Source, parsed.Destination, h.Source, h.Destination)
+	}
+}
+
+func TestProxyProtoConnNetConn(t *testing.T) {
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	pc := &proxyProtoConn{Conn: c, header: &ProxyProtocolHeader{Version: 1}}
+	if netConn(pc) != c {
+		t.Errorf("netConn didn't unwrap the PROXY protocol connection")
+	}
+	if netConn(c) != c {
+		t.Errorf("netConn changed an unwrapped connection")
+	}
+}
+
+func TestProxyProtocolForwarding(t *testing.T) {
+	Convey("PROXY protocol headers are accepted from clients and sent upstream", t, func() {
+		// Upstream server which echoes back the PROXY header it received.
+		upstream, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		defer upstream.Close()
+		go func() {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			r := bufio.NewReader(c)
+			line, _ := r.ReadString('\n')
+			if _, err := http.ReadRequest(r); err != nil {
+				return
+			}
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(line), line)
+		}()
+
+		proxy := NewProxyHttpServer()
+		proxy.AcceptProxyProtocol = true
+		proxy.SendProxyProtocol = 1
+
+		var sourceIP string
+		proxy.HandleRequestFunc(func(ctx *ProxyCtx) Next {
+			sourceIP = ctx.SourceIP
+			return NEXT
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "PROXY TCP4 10.1.2.3 192.168.1.10 5555 80\r\n")
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Addr().String())
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		So(err, ShouldEqual, nil)
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldEqual, nil)
+
+		So(sourceIP, ShouldEqual, "10.1.2.3:5555")
+		So(string(body), ShouldEqual, "PROXY TCP4 10.1.2.3 192.168.1.10 5555 80\r\n")
+	})
+
+	Convey("Requests to an IP literal are forwarded rather than served as direct requests", t, func() {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("upstream"))
+		}))
+		defer upstream.Close()
+
+		proxy := NewProxyHttpServer()
+		proxy.AcceptProxyProtocol = true
+		proxy.NonProxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("proxy"))
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		// The header's destination is the address named by the Host header, as it would be for
+		// an intercepted request.
+		dst := upstream.Listener.Addr().(*net.TCPAddr)
+		fmt.Fprintf(conn, "PROXY TCP4 10.1.2.3 %s 5555 %d\r\n", dst.IP, dst.Port)
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", dst)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		So(err, ShouldEqual, nil)
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "upstream")
+	})
+
+	Convey("Connections without a PROXY header are dropped", t, func() {
+		proxy := NewProxyHttpServer()
+		proxy.AcceptProxyProtocol = true
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		go proxy.ServeHTTPListener(ln)
+		defer ln.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		So(err, ShouldNotEqual, nil)
+	})
+}
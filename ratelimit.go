@@ -0,0 +1,208 @@
+package goproxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Smallest burst allowed by a tokenBucket, so that slow limits don't fragment reads into tiny
+// pieces.
+const minRateLimitBurst = 1500
+
+// A token bucket shared by every connection it limits. Readers take tokens after each read and
+// sleep off any debt, so the combined throughput of all connections converges on the rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second. Zero means unlimited.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(bytesPerSecond)
+	b.burst = b.rate / 10
+	if b.burst < minRateLimitBurst {
+		b.burst = minRateLimitBurst
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	if b.last.IsZero() {
+		b.tokens = b.burst
+		b.last = time.Now()
+	}
+}
+
+func (b *tokenBucket) limited() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0
+}
+
+// Returns the largest read which fits in a single burst, or n if the bucket is unlimited.
+func (b *tokenBucket) limit(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate > 0 && float64(n) > b.burst {
+		return int(b.burst)
+	}
+	return n
+}
+
+// Accounts for n bytes which have been transferred, sleeping until the bucket is no longer in
+// debt.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Upload and download limits shared by all connections of a client or to a destination.
+type rateLimit struct {
+	up, down tokenBucket
+}
+
+// Rate limits set by handlers, keyed by client IP and by destination host. The zero value is
+// ready to use.
+type rateLimitRegistry struct {
+	mu           sync.Mutex
+	clients      map[string]*rateLimit
+	destinations map[string]*rateLimit
+}
+
+// Sets the limits for key in m, creating the map if needed. Limits of 0 in both directions
+// remove the entry; connections which already hold it become unlimited.
+func (r *rateLimitRegistry) set(m *map[string]*rateLimit, key string, up, down int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if *m == nil {
+		*m = make(map[string]*rateLimit)
+	}
+	limit, ok := (*m)[key]
+	if !ok {
+		if up <= 0 && down <= 0 {
+			return
+		}
+		limit = &rateLimit{}
+		(*m)[key] = limit
+	}
+
+	limit.up.setRate(up)
+	limit.down.setRate(down)
+	if up <= 0 && down <= 0 {
+		delete(*m, key)
+	}
+}
+
+// Returns the limits which apply to a connection, or nil if there are none.
+func (r *rateLimitRegistry) lookup(client, destination string) []*rateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var limits []*rateLimit
+	if limit, ok := r.clients[client]; ok {
+		limits = append(limits, limit)
+	}
+	if limit, ok := r.destinations[destination]; ok {
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+// Returns the IP address the client connected from.
+func (ctx *ProxyCtx) clientIP() string {
+	if addr, ok := ctx.ClientAddr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return strings.Trim(stripHostPort(ctx.SourceIP), "[]")
+}
+
+// SetRateLimit caps the bandwidth available to the client, in bytes per second, from the client
+// (up) and to it (down). The limit is shared by all connections from the client's IP address and
+// applies to tunnels opened after the call, so call it from a connect or request handler. A
+// limit of 0 in both directions removes it.
+func (ctx *ProxyCtx) SetRateLimit(up, down int64) {
+	r := &ctx.Proxy.rateLimits
+	r.set(&r.clients, ctx.clientIP(), up, down)
+}
+
+// SetDestinationRateLimit caps the bandwidth used by all clients to reach this request's
+// destination host, in bytes per second, like SetRateLimit. When both apply, a connection is
+// held to the lower of the two limits.
+func (ctx *ProxyCtx) SetDestinationRateLimit(up, down int64) {
+	r := &ctx.Proxy.rateLimits
+	r.set(&r.destinations, strings.ToLower(stripHostPort(ctx.host)), up, down)
+}
+
+// Wraps one side of a tunnel with the client and destination rate limits which apply to it. c is
+// the client connection if upload is set, and the upstream connection otherwise.
+func (ctx *ProxyCtx) rateLimited(c net.Conn, upload bool) net.Conn {
+	limits := ctx.Proxy.rateLimits.lookup(ctx.clientIP(), strings.ToLower(stripHostPort(ctx.host)))
+	if len(limits) == 0 {
+		return c
+	}
+
+	var buckets []*tokenBucket
+	for _, limit := range limits {
+		bucket := &limit.down
+		if upload {
+			bucket = &limit.up
+		}
+		if bucket.limited() {
+			buckets = append(buckets, bucket)
+		}
+	}
+	if len(buckets) == 0 {
+		return c
+	}
+	return &rateLimitedConn{Conn: c, buckets: buckets}
+}
+
+// A net.Conn whose reads are throttled by one or more shared token buckets.
+type rateLimitedConn struct {
+	net.Conn
+	buckets []*tokenBucket
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	size := len(b)
+	for _, bucket := range c.buckets {
+		size = bucket.limit(size)
+	}
+
+	n, err := c.Conn.Read(b[:size])
+	if n > 0 {
+		for _, bucket := range c.buckets {
+			bucket.take(n)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,86 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSharedByClient(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}
+	ctx := &ProxyCtx{Proxy: proxy, ClientAddr: client, host: "example.com:443"}
+	ctx.SetRateLimit(200000, 0)
+
+	// Two connections from the same client share 200KB/s, so 100KB takes about 400ms after the
+	// initial burst.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		server, conn := net.Pipe()
+		limited := ctx.rateLimited(conn, true)
+		if _, ok := limited.(*rateLimitedConn); !ok {
+			t.Fatalf("connection isn't rate limited: %T", limited)
+		}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			server.Write(make([]byte, 50000))
+			server.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			if n, _ := io.Copy(ioutil.Discard, limited); n != 50000 {
+				t.Errorf("read %d bytes, want 50000", n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("transfer took %v, want about 400ms", elapsed)
+	}
+
+	// Downloads and other clients aren't limited.
+	if c := ctx.rateLimited(nil, false); c != nil {
+		t.Errorf("download is limited by an upload-only limit: %T", c)
+	}
+	other := &ProxyCtx{Proxy: proxy, ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.11")}, host: "example.org:443"}
+	if limits := proxy.rateLimits.lookup(other.clientIP(), "example.org"); len(limits) != 0 {
+		t.Errorf("other client has %d limits", len(limits))
+	}
+
+	ctx.SetRateLimit(0, 0)
+	if len(proxy.rateLimits.clients) != 0 {
+		t.Errorf("limit wasn't removed")
+	}
+}
+
+func TestDestinationRateLimit(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	ctx := &ProxyCtx{Proxy: proxy, ClientAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, host: "Example.com:443"}
+	ctx.SetDestinationRateLimit(0, 1000)
+	ctx.SetRateLimit(0, 5000)
+
+	limits := proxy.rateLimits.lookup("10.0.0.2", "example.com")
+	if len(limits) != 1 || limits[0].down.rate != 1000 {
+		t.Fatalf("got limits %+v, want the destination limit", limits)
+	}
+	if got := len(proxy.rateLimits.lookup("10.0.0.1", "example.com")); got != 2 {
+		t.Errorf("got %d limits, want client and destination", got)
+	}
+
+	// Reads are capped to the smaller burst.
+	c := ctx.rateLimited(nil, false).(*rateLimitedConn)
+	size := 65536
+	for _, b := range c.buckets {
+		size = b.limit(size)
+	}
+	if size != minRateLimitBurst {
+		t.Errorf("read size %d, want %d", size, minRateLimitBurst)
+	}
+}
@@ -0,0 +1,179 @@
+package goproxy
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/winstonprivacyinc/go-conntrack"
+)
+
+// DestinationResolver determines the original destination of a transparently intercepted
+// connection. This is required for non-TLS protocols or for connections initiated by devices
+// which do not send a valid SNI field in the CLIENTHELLO message.
+//
+// ResolveDestination returns the destination as an IP address, with a port if the resolver
+// knows it, or "" if it couldn't be determined. Implementations must not read from, write to or
+// close the connection.
+type DestinationResolver interface {
+	ResolveDestination(c net.Conn) string
+}
+
+// DestinationResolverFunc adapts an ordinary function to a DestinationResolver.
+type DestinationResolverFunc func(c net.Conn) string
+
+func (f DestinationResolverFunc) ResolveDestination(c net.Conn) string {
+	return f(c)
+}
+
+// Returns the connection wrapped by c, such as the socket beneath a PROXY protocol connection,
+// so that its socket options can be read.
+func netConn(c net.Conn) net.Conn {
+	for {
+		wc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = wc.NetConn()
+	}
+}
+
+// OriginalDstResolver reads the original destination of connections redirected by an iptables
+// REDIRECT or DNAT rule through the SO_ORIGINAL_DST socket option. Only supported on Linux.
+type OriginalDstResolver struct{}
+
+// TPROXYResolver resolves connections intercepted by an iptables TPROXY rule. These keep their
+// original destination, so it is simply the local address of the socket.
+type TPROXYResolver struct{}
+
+func (TPROXYResolver) ResolveDestination(c net.Conn) string {
+	if c.LocalAddr() == nil {
+		return ""
+	}
+	return c.LocalAddr().String()
+}
+
+// ConntrackResolver looks the connection up in the conntrack tables, matching on the client's
+// source IP and port. This works for any kind of NAT but reads the entire table on every call,
+// so it should come last in a ChainedResolver. Like the conntrak lookup it replaces, it returns
+// the destination IP without a port.
+type ConntrackResolver struct{}
+
+func (ConntrackResolver) ResolveDestination(c net.Conn) string {
+	src, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || src.Port == 0 {
+		log.Printf("[ERROR] Couldn't determine source address of connection [%v]. Dropping connection request.\n", c.RemoteAddr())
+		return ""
+	}
+
+	connections, err := conntrack.Flows()
+	if err != nil {
+		log.Printf("[ERROR] Couldn't read connection table. Dropping connection request. [%v]\n", err)
+		return ""
+	}
+
+	for _, flow := range connections {
+		if flow.Original.SPort == src.Port && flow.Original.Source.Equal(src.IP) {
+			return flow.Original.Destination.String()
+		}
+	}
+	return ""
+}
+
+// Default size and lifetime of the ChainedResolver cache. Entries must expire reasonably quickly
+// because clients reuse source ports.
+const (
+	defaultResolverCacheSize = 1024
+	defaultResolverCacheTTL  = 30 * time.Second
+)
+
+// ChainedResolver tries each of its resolvers in order and returns the first destination found.
+// Results are cached by the connection's 4-tuple (source and local address). When the cache is
+// full, the least recently used entry is evicted.
+type ChainedResolver struct {
+	resolvers []DestinationResolver
+	size      int
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Most recently used first
+}
+
+type resolvedDestination struct {
+	key         string
+	destination string
+	expires     time.Time
+}
+
+// NewChainedResolver returns a resolver which tries each of the given resolvers in order.
+func NewChainedResolver(resolvers ...DestinationResolver) *ChainedResolver {
+	return &ChainedResolver{
+		resolvers: resolvers,
+		size:      defaultResolverCacheSize,
+		ttl:       defaultResolverCacheTTL,
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// Returns the default resolver chain: SO_ORIGINAL_DST, then conntrack.
+func defaultDestinationResolver() DestinationResolver {
+	return NewChainedResolver(OriginalDstResolver{}, ConntrackResolver{})
+}
+
+func (cr *ChainedResolver) ResolveDestination(c net.Conn) string {
+	var key string
+	if c.RemoteAddr() != nil && c.LocalAddr() != nil {
+		key = c.RemoteAddr().String() + "->" + c.LocalAddr().String()
+		if destination, ok := cr.lookup(key); ok {
+			return destination
+		}
+	}
+
+	for _, r := range cr.resolvers {
+		if destination := r.ResolveDestination(c); destination != "" {
+			if key != "" {
+				cr.store(key, destination)
+			}
+			return destination
+		}
+	}
+	return ""
+}
+
+func (cr *ChainedResolver) lookup(key string) (string, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	el, ok := cr.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*resolvedDestination)
+	if time.Now().After(entry.expires) {
+		cr.lru.Remove(el)
+		delete(cr.entries, key)
+		return "", false
+	}
+	cr.lru.MoveToFront(el)
+	return entry.destination, true
+}
+
+func (cr *ChainedResolver) store(key, destination string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	entry := &resolvedDestination{key: key, destination: destination, expires: time.Now().Add(cr.ttl)}
+	if el, ok := cr.entries[key]; ok {
+		el.Value = entry
+		cr.lru.MoveToFront(el)
+		return
+	}
+	cr.entries[key] = cr.lru.PushFront(entry)
+
+	for cr.lru.Len() > cr.size {
+		oldest := cr.lru.Remove(cr.lru.Back()).(*resolvedDestination)
+		delete(cr.entries, oldest.key)
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package goproxy
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h and linux/in6.h.
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+	ipv6Transparent   = 75
+)
+
+func (OriginalDstResolver) ResolveDestination(c net.Conn) string {
+	c = netConn(c)
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return ""
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var ipv6 bool
+	if local, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		ipv6 = local.IP.To4() == nil
+	}
+
+	var ip net.IP
+	var port int
+	var sockerr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in an IPv6MTUInfo, which the syscall package can read for us.
+			var info *syscall.IPv6MTUInfo
+			info, sockerr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+			if sockerr == nil {
+				ip = net.IP(info.Addr.Addr[:])
+				port = ntohs(info.Addr.Port)
+			}
+		} else {
+			// Likewise, sockaddr_in fits in an IPv6Mreq.
+			var mreq *syscall.IPv6Mreq
+			mreq, sockerr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockerr == nil {
+				ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+				port = int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+			}
+		}
+	})
+	if err != nil || sockerr != nil {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// Converts a port from network to host byte order.
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+// Reports whether c was accepted on a socket with IP_TRANSPARENT set, as TPROXY requires. The
+// local address of such a connection is the client's original destination.
+func isTransparentConn(c net.Conn) bool {
+	sc, ok := netConn(c).(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var transparent bool
+	raw.Control(func(fd uintptr) {
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT); err == nil && v != 0 {
+			transparent = true
+		} else if v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent); err == nil && v != 0 {
+			transparent = true
+		}
+	})
+	return transparent
+}
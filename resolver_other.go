@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package goproxy
+
+import (
+	"net"
+)
+
+// SO_ORIGINAL_DST is specific to Linux netfilter.
+func (OriginalDstResolver) ResolveDestination(c net.Conn) string {
+	return ""
+}
+
+// TPROXY is specific to Linux netfilter.
+func isTransparentConn(c net.Conn) bool {
+	return false
+}
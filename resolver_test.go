@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Returns both ends of a loopback TCP connection.
+func tcpConnPair() (client net.Conn, server net.Conn, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func TestDestinationResolvers(t *testing.T) {
+	Convey("Destination resolvers", t, func() {
+		client, server, err := tcpConnPair()
+		So(err, ShouldEqual, nil)
+		defer client.Close()
+		defer server.Close()
+
+		Convey("TPROXYResolver returns the local address of the socket", func() {
+			So(TPROXYResolver{}.ResolveDestination(server), ShouldEqual, server.LocalAddr().String())
+		})
+
+		Convey("OriginalDstResolver returns nothing for a connection which wasn't redirected", func() {
+			So(OriginalDstResolver{}.ResolveDestination(server), ShouldEqual, "")
+		})
+
+		Convey("ChainedResolver returns the first destination found", func() {
+			var calls []string
+			resolver := func(name, destination string) DestinationResolver {
+				return DestinationResolverFunc(func(c net.Conn) string {
+					calls = append(calls, name)
+					return destination
+				})
+			}
+
+			chain := NewChainedResolver(resolver("first", ""), resolver("second", "10.0.0.1:443"), resolver("third", "10.0.0.2:443"))
+			So(chain.ResolveDestination(server), ShouldEqual, "10.0.0.1:443")
+			So(calls, ShouldResemble, []string{"first", "second"})
+
+			Convey("and caches it by 4-tuple", func() {
+				calls = nil
+				So(chain.ResolveDestination(server), ShouldEqual, "10.0.0.1:443")
+				So(calls, ShouldBeEmpty)
+
+				// A different connection is resolved again.
+				client2, server2, err := tcpConnPair()
+				So(err, ShouldEqual, nil)
+				defer client2.Close()
+				defer server2.Close()
+
+				So(chain.ResolveDestination(server2), ShouldEqual, "10.0.0.1:443")
+				So(calls, ShouldResemble, []string{"first", "second"})
+			})
+		})
+
+		Convey("ChainedResolver doesn't cache failures", func() {
+			calls := 0
+			chain := NewChainedResolver(DestinationResolverFunc(func(c net.Conn) string {
+				calls++
+				return ""
+			}))
+			So(chain.ResolveDestination(server), ShouldEqual, "")
+			So(chain.ResolveDestination(server), ShouldEqual, "")
+			So(calls, ShouldEqual, 2)
+		})
+
+		Convey("ChainedResolver cache stays within its size", func() {
+			chain := NewChainedResolver(TPROXYResolver{})
+			chain.size = 2
+			for i := 0; i < 5; i++ {
+				chain.store(string(rune('a'+i)), "10.0.0.1:443")
+			}
+			So(len(chain.entries), ShouldBeLessThanOrEqualTo, 2)
+
+			Convey("by evicting the least recently used entry", func() {
+				_, ok := chain.lookup("d")
+				So(ok, ShouldBeTrue)
+				chain.store("f", "10.0.0.2:443")
+				_, ok = chain.lookup("d")
+				So(ok, ShouldBeTrue)
+				_, ok = chain.lookup("e")
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -6,7 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"time"
-	//"net/http/httptrace"
+	"net/http/httptrace"
 	"context"
 	"github.com/winstonprivacyinc/winston/shadownetwork"
 	//"errors"
@@ -79,6 +79,9 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 		if ctx.Proxy.FlushIdleConnections {
 			ctx.Proxy.Transport.CloseIdleConnections()
 			ctx.Proxy.FlushIdleConnections = false
+			if ctx.Proxy.Metrics != nil {
+				ctx.Proxy.Metrics.idle.reset()
+			}
 		}
 
 		ctx.RoundTripper = ctx.wrapTransport(&tr)
@@ -139,6 +142,12 @@ func (ctx *ProxyCtx) wrapTransport(tr *http.RoundTripper) RoundTripper {
 
 		//fmt.Println("[DEBUG] GoProxy.RoundTripper() Start")
 
+		// Record upstream latency, and follow connections through the idle pool of our own Transport.
+		if ctx.Proxy.Metrics != nil {
+			trace := ctx.Proxy.Metrics.clientTrace(*tr == http.RoundTripper(ctx.Proxy.Transport))
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		}
+
 		resp, err := (*tr).RoundTrip(req)
 
 		// Record the original status code
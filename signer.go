@@ -11,6 +11,9 @@ package goproxy
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -18,6 +21,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/winstonprivacyinc/dns"
 	"github.com/winstonprivacyinc/winston/intransport"
@@ -59,15 +63,13 @@ func getWildcardHost(host string) string {
 // Used to resolve certificate chains (Global)
 var certtransport *intransport.InTransport
 
-// Global lock on the certificate store.
-var certmu sync.RWMutex
-
 // Stores metadata about a particular host. Used to improve performance.
 type HostInfo struct {
 	LastVerify  time.Time
 	NextAttempt time.Time // Set to future time for invalid certs to avoid frequent reloading
 	mu          sync.Mutex
 	Config      *tls.Config
+	probeErr    error // Why the origin couldn't be probed, if there's no Config
 }
 
 // Maintains a global list of immutable TLS Configs which can be used for TLS handshakes.
@@ -80,9 +82,188 @@ type GoproxyConfigServer struct {
 	validity time.Duration
 	//*tls.Config
 	bypassDnsDialer *net.Dialer // Custom DNS resolver
-	Host            map[string]*HostInfo
+	hosts           certCache
+	flights         certFlights
 	//Config		map[string]
 	IsExternal func(string) bool
+
+	// TLS versions negotiated with clients using the generated configs. Default to TLS 1.1 and
+	// TLS 1.3. MaxVersion also caps the version used to fetch certificates from origin servers.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// Type of key in the leaf certificates issued to clients. Defaults to LeafKeyRSA.
+	LeafKeyType LeafKeyType
+
+	// If set, generated certificates are persisted here and loaded on demand after a restart.
+	Store CertStore
+
+	// Bounds the certificates kept in memory. See CertCacheLimits for the defaults.
+	CacheLimits CertCacheLimits
+
+	// Fetches the origin certificates which are copied. Defaults to a DialCertProber using the
+	// bypass DNS dialer.
+	Prober CertProber
+
+	// How long to wait before probing an origin again after a failure.
+	NegativeCache NegativeCachePolicy
+
+	// Selects the origin certificate attributes copied into new certificates. Defaults to
+	// DefaultMirrorProfile.
+	Mirror *MirrorProfile
+
+	// ECDSA leaf key, generated on first use.
+	ecdsaOnce  sync.Once
+	ecdsaPriv  *ecdsa.PrivateKey
+	ecdsaKeyID []byte
+	ecdsaErr   error
+}
+
+// LeafKeyType selects the key type of the certificates GoproxyConfigServer issues.
+type LeafKeyType int
+
+const (
+	LeafKeyRSA   LeafKeyType = iota // 2048-bit RSA, which every client supports
+	LeafKeyECDSA                    // ECDSA P-256, which is faster but unsupported by some older clients
+	LeafKeyAuto                     // Both, choosing ECDSA for each client which supports it
+)
+
+// Returns the TLS version bounds for the generated configs.
+func (c *GoproxyConfigServer) versions() (min, max uint16) {
+	min, max = c.MinVersion, c.MaxVersion
+	if min == 0 {
+		min = tls.VersionTLS11
+	}
+	if max == 0 {
+		max = tls.VersionTLS13
+	}
+	return min, max
+}
+
+// Returns the ECDSA P-256 key shared by all ECDSA leaf certificates, and its subject key ID.
+func (c *GoproxyConfigServer) ecdsaKey() (*ecdsa.PrivateKey, []byte, error) {
+	c.ecdsaOnce.Do(func() {
+		c.ecdsaPriv, c.ecdsaErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if c.ecdsaErr != nil {
+			return
+		}
+		c.ecdsaKeyID, c.ecdsaErr = subjectKeyID(c.ecdsaPriv.Public())
+	})
+	return c.ecdsaPriv, c.ecdsaKeyID, c.ecdsaErr
+}
+
+// Subject Key Identifier support for end entity certificate.
+// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write(pkixpub)
+	return h.Sum(nil), nil
+}
+
+// Signs a leaf certificate for key, filling in the serial number and subject key ID of tmpl.
+func (c *GoproxyConfigServer) issue(tmpl x509.Certificate, key crypto.Signer, keyID []byte) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	if tmpl.SubjectKeyId == nil {
+		tmpl.SubjectKeyId = keyID
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, &tmpl, c.Root, key.Public(), c.capriv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse certificate bytes so that we have a leaf certificate.
+	x509c, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{raw, c.Root.Raw},
+		PrivateKey:  key,
+		Leaf:        x509c,
+	}, nil
+}
+
+// Issues the leaf certificates for the configured LeafKeyType, preferred certificate first.
+func (c *GoproxyConfigServer) issueLeaves(tmpl *x509.Certificate) ([]*tls.Certificate, error) {
+	var leaves []*tls.Certificate
+	if c.LeafKeyType != LeafKeyECDSA {
+		tlsc, err := c.issue(*tmpl, c.priv, c.keyID)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, tlsc)
+	}
+	if c.LeafKeyType != LeafKeyRSA {
+		priv, keyID, err := c.ecdsaKey()
+		if err != nil {
+			return nil, err
+		}
+		ecdsaTmpl := *tmpl
+		// Key encipherment only applies to RSA keys.
+		ecdsaTmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+		ecdsaTmpl.KeyUsage |= x509.KeyUsageDigitalSignature
+		tlsc, err := c.issue(ecdsaTmpl, priv, keyID)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, tlsc)
+	}
+	return leaves, nil
+}
+
+// Returns a GetCertificate callback which serves the ECDSA certificate to clients which can
+// verify it, and the RSA certificate to the rest.
+func selectLeafCertificate(rsaCert, ecdsaCert *tls.Certificate, maxVersion uint16) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if supportsECDSA(hello, maxVersion) {
+			return ecdsaCert, nil
+		}
+		return rsaCert, nil
+	}
+}
+
+// Returns true if the client accepts ECDSA P-256 signatures and, unless TLS 1.3 will be
+// negotiated, offers a cipher suite which is authenticated with ECDSA.
+func supportsECDSA(hello *tls.ClientHelloInfo, maxVersion uint16) bool {
+	accepted := false
+	for _, scheme := range hello.SignatureSchemes {
+		if scheme == tls.ECDSAWithP256AndSHA256 {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return false
+	}
+
+	if maxVersion >= tls.VersionTLS13 {
+		for _, v := range hello.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return true
+			}
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
 }
 
 // NewConfig creates a MITM config using the CA certificate and
@@ -142,17 +323,10 @@ func NewConfigServer(filename string, ca *x509.Certificate, privateKey interface
 	if err != nil {
 		return nil, err
 	}
-	pub := priv.Public()
-
-	// Subject Key Identifier support for end entity certificate.
-	// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
-	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	keyID, err := subjectKeyID(priv.Public())
 	if err != nil {
 		return nil, err
 	}
-	h := sha1.New()
-	h.Write(pkixpub)
-	keyID := h.Sum(nil)
 
 	tlsConfigServer := &GoproxyConfigServer{
 		Root:            ca,
@@ -162,7 +336,6 @@ func NewConfigServer(filename string, ca *x509.Certificate, privateKey interface
 		validity:        time.Hour * 24 * 3650,
 		bypassDnsDialer: WhitelistedDNSDialer(),
 		//Config:	  		make(map[string]*tls.Config),//
-		Host:    make(map[string]*HostInfo),
 		RootCAs: x509.NewCertPool(),
 	}
 
@@ -219,6 +392,16 @@ func (c *GoproxyConfigServer) cert(hostname string) (*tls.Config, error) {
 	return c.certWithCommonName(hostname, "")
 }
 
+// Returns the number of hosts with a cached TLS configuration.
+func (c *GoproxyConfigServer) CachedCerts() int {
+	return c.hosts.len()
+}
+
+// Returns the size of the certificate cache and the number of hosts evicted from it.
+func (c *GoproxyConfigServer) CacheStats() CertCacheStats {
+	return c.hosts.stats()
+}
+
 // Removes the certificate associated with the given hostname from the cache. This is necessary if we change the
 // whitelist or blacklist settings for a domain.
 func (c *GoproxyConfigServer) FlushCert(hostname string) {
@@ -227,12 +410,14 @@ func (c *GoproxyConfigServer) FlushCert(hostname string) {
 	if err == nil {
 		hostname = host
 	}
-	certmu.Lock()
-	defer certmu.Unlock()
-
 	//fmt.Println("[DEBUG] FlushCert", hostname)
 
-	delete(c.Host, hostname)
+	c.hosts.remove(hostname)
+	if c.Store != nil {
+		if err := c.Store.Delete(hostname); err != nil {
+			fmt.Printf("[WARN] Couldn't remove stored certificate for %s: %v\n", hostname, err)
+		}
+	}
 
 	// Get the pointer to the HostInfo struct as we have to delete all references to it.
 	//ptr, found := c.getMatchingTlsConfig(hostname)
@@ -280,7 +465,54 @@ func (c *GoproxyConfigServer) FlushCert(hostname string) {
 // If commonName is provided, it will be used in the certificate. This is used to
 // service non-SNI requests.
 // TODO: commonName may no longer be needed. Refactor to remove it.
+// Concurrent calls for the same host share a single origin probe and certificate, and its error,
+// whatever their commonName. Like cached certificates, the first caller's commonName is used.
 func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+
+	// Most lookups are for a cached certificate which was verified recently. These don't need to
+	// wait on other hosts' calls.
+	if info, ok := c.hosts.get(c.CacheLimits, host); ok {
+		if config, err := info.current(); err != errCertStale {
+			return config, err
+		}
+	}
+
+	return c.flights.do(host, func() (*tls.Config, error) {
+		return c.loadOrIssueCert(hostname, commonName)
+	})
+}
+
+// How often a cached certificate is verified against the hostname and CA.
+const certVerifyInterval = 60 * time.Minute
+
+// Returned by HostInfo.current() when the cached config has to be verified again, or the origin
+// probed again, before it can be used.
+var errCertStale = errors.New("cached certificate is stale")
+
+// Returns the cached config, or the cached probe error, if it can be used as it is.
+func (info *HostInfo) current() (*tls.Config, error) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	if info.Config == nil {
+		if info.NextAttempt.After(time.Now()) {
+			return nil, info.probeErr
+		}
+		return nil, errCertStale
+	}
+	if info.LastVerify.Before(time.Now().Add(-certVerifyInterval)) {
+		return nil, errCertStale
+	}
+	return info.Config, nil
+}
+
+// Returns the cached config for hostname, verifying it if it hasn't been verified in the last hour, or
+// creates a new one. Called by certWithCommonName.
+func (c *GoproxyConfigServer) loadOrIssueCert(hostname string, commonName string) (*tls.Config, error) {
 
 	//trace := false
 	//if strings.Contains(hostname, "hsforms.net") {
@@ -304,19 +536,20 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 		isIP = true
 	}
 
-	// Need a lock to protect the certificate store. Can't block here because we may already be writing a certificate.
-	certmu.RLock()
-
 	// Check for exact match
 	//if trace {
 	//	fmt.Printf("[DEBUG] Looking for existing certificate... (%s)\n", host)
 	//}
 	//hostmetadata, found := c.getMatchingTlsConfig(host)
-	hostmetadata, found := c.Host[host]
-	certmu.RUnlock()
+	hostmetadata, found := c.hosts.peek(c.CacheLimits, host)
+
+	// After a restart, pick up the certificate generated last time.
+	if !found && c.Store != nil {
+		hostmetadata, found = c.loadHost(host)
+	}
 
-	// In a race condition, it is possible that multiple threads could attempt to create a metadata entry. That's ok
-	// because in the worst cast, we'll fetch the downstream certificate multiple times on the initial call.
+	// Concurrent calls for this host wait on certWithCommonName, so only one of them gets here and creates the
+	// metadata entry. Calls for other hosts may run at the same time.
 	if !found {
 		hostmetadata = &HostInfo{}
 	}
@@ -326,6 +559,14 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	defer (*hostmetadata).mu.Unlock()
 
 	// A write lock on the HostInfo struct is held at this point. We can write to it freely.
+	// If the last probe failed, give the same error until it's time to try again.
+	if found && (*hostmetadata).Config == nil {
+		if (*hostmetadata).NextAttempt.After(time.Now()) {
+			return nil, (*hostmetadata).probeErr
+		}
+		found = false
+	}
+
 	if found {
 		//if trace {
 		//	fmt.Printf("[DEBUG] Cached cert used for %s.\n     Subject: %+v\n     DNS Names:%+v\n     IssuingCertificateURL: %+v\n     Issuer: %+v\n     Valid: %+v - %+v\n", hostname, tlsc.Leaf.Subject, tlsc.Leaf.DNSNames, tlsc.Leaf.IssuingCertificateURL, tlsc.Leaf.Issuer, tlsc.Leaf.NotBefore, tlsc.Leaf.NotAfter)
@@ -334,7 +575,7 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 		// Check validity of the certificate for hostname match, expiry, etc. In
 		// particular, if the cached certificate has expired, create a new one.
 		// Don't check more than once an hour.
-		if hostmetadata.LastVerify.Before(time.Now().Add(-60 * time.Minute)) {
+		if hostmetadata.LastVerify.Before(time.Now().Add(-certVerifyInterval)) {
 			tlsc, ok := (*hostmetadata).Config.NameToCertificate[host]
 			//if trace {
 			//	fmt.Printf("[DEBUG] Verifying certificate [%s]\n", host)
@@ -362,6 +603,7 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 			if err == nil {
 				// Update the last verification time
 				(*hostmetadata).LastVerify = time.Now()
+				c.storeHost(host, hostmetadata)
 				return (*hostmetadata).Config, nil
 			}
 		} else {
@@ -390,106 +632,45 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	if !strings.Contains(hostname, "winston.conf") && (*hostmetadata).NextAttempt.Before(time.Now()) {
 
 		//if trace {
-		//	fmt.Println("[DEBUG] Signer.go() DialWithDialer()", host)
+		//	fmt.Println("[DEBUG] Signer.go() ProbeCert()", host)
 		//}
 
-		// Check if this host is blocked. If it resolved locally, it means we blocked it
-		// and a TLS connection attempt will simply timeout.
-		// RLS 12/1/2018 - This proved to be unnecessary and slow.
-		//start := time.Now()
-		//isexternal := true
-		//if c.IsExternal != nil {
-		//	isexternal = c.IsExternal(hostname)
-		//}
-		//fmt.Println("[DEBUG] signer.go - IsExternal elapsed time: ", time.Since(start))
-		if true {
-
-			var conn *tls.Conn
-
-			// RLS - Disable support for TLS 1.0
-			start := time.Now()
-			conn, err = tls.DialWithDialer(c.bypassDnsDialer, "tcp", host+":"+port,
-				&tls.Config{
-					InsecureSkipVerify: true,
-					MinVersion:         tls.VersionTLS10,
-					MaxVersion:         tls.VersionTLS12,
-				})
-			elapsed := time.Since(start)
-			if err != nil {
-				// Timeouts should be rare but they aren't. CoreDNS appears to single thread some lookups
-				// (perhaps when loading the hosts file) resulting in a stampede timeout.
-				//fmt.Printf("[DEBUG] Signer.go - Error while dialing %s: %v\n", host, err, elapsed)
-				if elapsed > time.Duration(2)*time.Second && strings.Contains(err.Error(), "timeout") {
-					// TEST - retry in event of timeout. A slight delay is better than a failed page load.
-					start = time.Now()
-					conn, err = tls.DialWithDialer(c.bypassDnsDialer, "tcp", host+":"+port,
-						&tls.Config{
-							InsecureSkipVerify: true,
-							MinVersion:         tls.VersionTLS10,
-							MaxVersion:         tls.VersionTLS12,
-						})
-					elapsed = time.Since(start)
-					if err != nil {
-						fmt.Printf("[DEBUG] Signer.go - Error while retrying. Giving up. %s %s: %v\n", host, err, elapsed)
-						return nil, err
-					} else {
-						fmt.Printf("[INFO] Signer.go - Retry succeeded. %s: %v\n", host, elapsed)
-					}
-				} else {
-					// Some other error happened. Don't retry.
-					return nil, err
+		policy := c.NegativeCache.withDefaults()
+		prober := c.prober()
+		chain, err := prober.ProbeCert(host, port)
+		if err != nil {
+			//fmt.Printf("[DEBUG] Signer.go - Error while probing %s: %v\n", host, err)
+			if policy.ProbeError > 0 {
+				(*hostmetadata).NextAttempt = time.Now().Add(policy.ProbeError)
+				if !found {
+					(*hostmetadata).probeErr = err
+					c.hosts.set(c.CacheLimits, host, hostmetadata)
 				}
+				c.storeHost(host, hostmetadata)
 			}
-
-			//fmt.Println("[DEBUG] Signer.go() DialWithDialer() completed", host)
-			// Only close the connection if we couldn't connect.
-			defer conn.Close()
-			if len(conn.ConnectionState().PeerCertificates) >= 1 {
-				//if trace {
-				//	fmt.Println("[DEBUG] Signer.go - verifying certificate...")
-				//}
-				origcert = conn.ConnectionState().PeerCertificates[0]
-
-				rawCerts := make([][]byte, len(conn.ConnectionState().PeerCertificates))
-				for i, cert := range conn.ConnectionState().PeerCertificates {
-					rawCerts[i] = cert.Raw
-				}
-
-				// We only verify here to check the intermediate certificate chain. We don't want errors
-				// to prevent us from copying the remote certificate to the store.
-				// TEST: We could have a stampede. If so, try to skip the expensive chain checks.
-				if hostmetadata.LastVerify.Before(time.Now().Add(-60 * time.Minute)) {
-					err = certtransport.VerifyPeerCertificate(rawCerts, nil)
-					if err != nil {
-						//if trace {
-						//	fmt.Println("[DEBUG] Signer.go - certificate verification failed - err:", err)
-						//}
-						(*hostmetadata).NextAttempt = time.Now().Add(24 * time.Hour)
-
-						// Don't need lock because we have are guaranteed to have a lock on the pointer to hostInfo
-						//certmu.Lock()
-						//c.Host[host] = hostmetadata
-						//certmu.Unlock()
-
-						// TEST: add bad certs anyway
-						badcert = true
-						//return nil
-					}
-				}
-
+			return nil, err
+		}
+		(*hostmetadata).probeErr = nil
+		origcert = chain[0]
+
+		// We only verify here to check the intermediate certificate chain. We don't want errors
+		// to prevent us from copying the remote certificate to the store.
+		// TEST: We could have a stampede. If so, try to skip the expensive chain checks.
+		if hostmetadata.LastVerify.Before(time.Now().Add(-certVerifyInterval)) {
+			err = prober.VerifyCert(chain)
+			if err != nil {
 				//if trace {
-				//	fmt.Printf("[DEBUG] certWithCommonName() - successfully retrieved remote certificate.\n")
+				//	fmt.Println("[DEBUG] Signer.go - certificate verification failed - err:", err)
 				//}
+				(*hostmetadata).NextAttempt = time.Now().Add(policy.Untrusted)
 
-				// TODO: Check upstream server's certificate and deny if it is encoded in SHA-1
-				// https://ssldecoder.org/?host=sha1-intermediate.badssl.com&port=&csr=&s=
-			} else {
-				fmt.Printf("[ERROR] signer.go - no peer certificates. This shouldn't happen. %s\n", host)
+				// TEST: add bad certs anyway
+				badcert = true
 			}
-		} //else {
-		//	fmt.Println("[DEBUG] Bypassing certificate lookup for local/blocked host", hostname)
-		//}
+		}
 
+		// TODO: Check upstream server's certificate and deny if it is encoded in SHA-1
+		// https://ssldecoder.org/?host=sha1-intermediate.badssl.com&port=&csr=&s=
 	}
 
 	//if trace {
@@ -497,16 +678,15 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	//}
 
 	// Create a new certificate.
-	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
-	if err != nil {
-		return nil, err
-	}
-
 	certificateCommonName := host
 	if len(commonName) > 0 {
 		certificateCommonName = commonName
 	}
 
+	// If we have a non-Winston certificate for an external site, copy the attributes selected by the profile.
+	profile := c.mirrorProfile()
+	mirror := origcert != nil && !strings.HasPrefix(host, "winston.conf")
+
 	// Determine the validity period. This has to be set when the certificate is created.
 	// If the intermediate certificate chain check failed, we need to invalidate the certificate and add it to the
 	// store. This prevents us from retrieving it over and over again. If we just add the original certificate,
@@ -516,7 +696,7 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	if badcert {
 		notafter = time.Now().Add(-365 * 24 * time.Hour)
 		notbefore = time.Now().Add(-365 * 24 * time.Hour)
-	} else if origcert != nil && !strings.HasPrefix(host, "winston.conf") {
+	} else if mirror && profile.Validity {
 		notafter = origcert.NotAfter
 		notbefore = origcert.NotBefore
 	} else {
@@ -532,12 +712,10 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	//fmt.Printf("[DEBUG] Creating x509 certificate. serial=%v CommonName=%s\n", serial, certificateCommonName)
 
 	tmpl := &x509.Certificate{
-		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   certificateCommonName,
 			Organization: []string{OrganizationName},
 		},
-		SubjectKeyId:          c.keyID,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -548,46 +726,18 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	if isIP {
 		tmpl.IPAddresses = []net.IP{ip}
 	} else {
-		tmpl.DNSNames = []string{host}
+		tmpl.DNSNames = profile.dnsNames(host)
 	}
 
-	// If we have a non-Winston certificate for an external site, then copy values from the original certificate to our new one
-	if origcert != nil && !strings.HasPrefix(host, "winston.conf") {
-
-		tmpl.Subject = origcert.Subject
-		//tmpl.NotBefore = origcert.NotBefore
-		//tmpl.NotAfter = origcert.NotAfter
-		tmpl.KeyUsage = origcert.KeyUsage
-		tmpl.AuthorityKeyId = origcert.AuthorityKeyId
-		tmpl.IPAddresses = origcert.IPAddresses
-
-		// If the DNS name points to winston.conf, then use the original hostname.
-		if len(origcert.DNSNames) > 0 && origcert.DNSNames[0] != "winston.conf" {
-			//fmt.Printf("  *** overwriting cert with original values: host=%s  DNSNames[0]=%s\n", originalhostname, origcert.DNSNames[0] )
-			tmpl.DNSNames = origcert.DNSNames
-		} else {
-			//fmt.Printf("  *** Blocked domain.: host=%s  DNSNames[0]=%s\n", originalhostname, hostname )
-			tmpl.DNSNames = []string{host}
-		}
+	if mirror {
+		profile.apply(tmpl, origcert)
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.Root, c.priv.Public(), c.capriv)
+	leaves, err := c.issueLeaves(tmpl)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse certificate bytes so that we have a leaf certificate.
-	x509c, err := x509.ParseCertificate(raw)
-	if err != nil {
-		return nil, err
-	}
-
-	tlsc := &tls.Certificate{
-		Certificate: [][]byte{raw, c.Root.Raw},
-		PrivateKey:  c.priv,
-		Leaf:        x509c,
-	}
-
 	//if trace {
 	//	fmt.Printf("[DEBUG] certWithCommonName - New cert created. Subject: %+v\n  Issuer: %+v\n  NotAfter=%v\n", tlsc.Leaf.Subject.CommonName, tlsc.Leaf.Issuer.CommonName, tmpl.NotAfter)
 	//}
@@ -595,27 +745,11 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 	// It's possible we have a race condition here with multiple goroutines having fetched the downstream certificate simultaneously.
 	// The certificate verification logic avoids stampede conditions and will bypass validation logic if it detects multiple requests.
 	// Therefore, we should check if a certificate already exists and only overwrite it if we determined it's invalid.
-	certmu.Lock()
-	defer certmu.Unlock()
 	//_, ok = c.NameToCertificate[host]
-	//hostmetadata, found = c.Host[host]
 	(*hostmetadata).LastVerify = time.Now()
 	if !found || badcert {
 		// Only add it if we didn't find it or ours is invalid
-
-		// Create new config
-		newtlsconfig := &tls.Config{
-			//RootCAs: x509.NewCertPool(),
-		}
-
-		newtlsconfig.RootCAs = c.RootCAs
-		newtlsconfig.Certificates = make([]tls.Certificate, 0)
-		newtlsconfig.Certificates = append(newtlsconfig.Certificates, *tlsc)
-		newtlsconfig.NameToCertificate = make(map[string]*tls.Certificate)
-		newtlsconfig.NameToCertificate[host] = tlsc
-		newtlsconfig.MinVersion = tls.VersionTLS11
-		newtlsconfig.MaxVersion = tls.VersionTLS12
-		newtlsconfig.Renegotiation = tls.RenegotiateFreelyAsClient
+		newtlsconfig := c.hostConfig(host, leaves)
 
 		// Hook the certificate chain verification
 		//if c.VerifyPeerCertificate != nil {
@@ -624,22 +758,49 @@ func (c *GoproxyConfigServer) certWithCommonName(hostname string, commonName str
 
 		(*hostmetadata).Config = newtlsconfig
 
-		c.Host[host] = hostmetadata
+		c.hosts.set(c.CacheLimits, host, hostmetadata)
 
 		// Parse Subject alternative names. Point all SANs at the same HostInfo object because they share certs.
 		//for _, sanhost := range origcert.DNSNames {
 		//	if sanhost != host {
 		//		//fmt.Printf("[DEBUG] Pointing %s at cert.\n", sanhost)
 		//		newtlsconfig.NameToCertificate[sanhost] = tlsc
-		//		c.Host[sanhost] = hostmetadata
+		//		c.hosts.set(c.CacheLimits, sanhost, hostmetadata)
 		//	}
 		//}
+
+		// We still hold the lock on this host, so the store can't be written to concurrently.
+		c.storeHost(host, hostmetadata)
 		return newtlsconfig, nil
 	}
 
 	return (*hostmetadata).Config, nil
 }
 
+// Creates the TLS config served to clients connecting to host. The first of leaves is given to
+// clients which don't send SNI.
+func (c *GoproxyConfigServer) hostConfig(host string, leaves []*tls.Certificate) *tls.Config {
+	newtlsconfig := &tls.Config{
+		//RootCAs: x509.NewCertPool(),
+	}
+
+	newtlsconfig.RootCAs = c.RootCAs
+	newtlsconfig.Certificates = make([]tls.Certificate, 0)
+	for _, leaf := range leaves {
+		newtlsconfig.Certificates = append(newtlsconfig.Certificates, *leaf)
+	}
+	newtlsconfig.NameToCertificate = make(map[string]*tls.Certificate)
+	newtlsconfig.NameToCertificate[host] = leaves[0]
+	newtlsconfig.MinVersion, newtlsconfig.MaxVersion = c.versions()
+	newtlsconfig.Renegotiation = tls.RenegotiateFreelyAsClient
+
+	// Clients without SNI are always given the first (RSA) certificate.
+	if len(leaves) > 1 {
+		newtlsconfig.GetCertificate = selectLeafCertificate(leaves[0], leaves[1], newtlsconfig.MaxVersion)
+	}
+	return newtlsconfig
+}
+
 // Used for unit testing. Gets a certificate from a server and port and creates a local version suitable for MITM.
 func (c *GoproxyConfigServer) GetTestCertificate(host string, port string) (*tls.Config, error) {
 
@@ -672,9 +833,6 @@ func (c *GoproxyConfigServer) GetTestCertificate(host string, port string) (*tls
 	//}
 
 	// Create a new certificate
-	certmu.Lock()
-	defer certmu.Unlock()
-
 	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
 	if err != nil {
 		return nil, err
@@ -758,7 +916,7 @@ func (c *GoproxyConfigServer) GetTestCertificate(host string, port string) (*tls
 
 	hostmetadata := &HostInfo{}
 	(*hostmetadata).Config = newtlsconfig
-	c.Host[host] = hostmetadata
+	c.hosts.set(c.CacheLimits, host, hostmetadata)
 
 	return newtlsconfig, nil
 }
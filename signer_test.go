@@ -1,5 +1,27 @@
 package goproxy
 
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/winstonprivacyinc/winston/intransport"
+)
+
 // RLS 2/22/2019 - Removed all MITM functionality
 
 /*
@@ -1075,3 +1097,586 @@ func TestSigner(t *testing.T) {
 
 }
 */
+
+// Returns a config server with a freshly generated CA, for hosts under winston.conf so that no
+// origin certificates are fetched.
+func newTestConfigServer(t testing.TB) *GoproxyConfigServer {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA", Organization: []string{OrganizationName}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := subjectKeyID(leafKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &GoproxyConfigServer{
+		Root:     ca,
+		RootCAs:  x509.NewCertPool(),
+		capriv:   caKey,
+		priv:     leafKey,
+		keyID:    keyID,
+		validity: time.Hour,
+	}
+	c.RootCAs.AddCert(ca)
+	return c
+}
+
+// Handshakes with a server using config and returns the client's view of the connection.
+func testHandshake(t *testing.T, config *tls.Config, client *tls.Config) tls.ConnectionState {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go tls.Server(serverConn, config).Handshake()
+
+	conn := tls.Client(clientConn, client)
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return conn.ConnectionState()
+}
+
+func TestSignerLeafKeyTypes(t *testing.T) {
+	c := newTestConfigServer(t)
+	client := func() *tls.Config {
+		return &tls.Config{RootCAs: c.RootCAs, ServerName: "a.winston.conf"}
+	}
+
+	// RSA by default, now with TLS 1.3.
+	config, err := c.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := testHandshake(t, config, client())
+	if _, ok := state.PeerCertificates[0].PublicKey.(*rsa.PublicKey); !ok || state.Version != tls.VersionTLS13 {
+		t.Errorf("got %T key with version %#x, want RSA with TLS 1.3", state.PeerCertificates[0].PublicKey, state.Version)
+	}
+
+	c.LeafKeyType = LeafKeyAuto
+	c.FlushCert("a.winston.conf")
+	config, err = c.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = testHandshake(t, config, client())
+	if _, ok := state.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("got %T key, want ECDSA for a modern client", state.PeerCertificates[0].PublicKey)
+	}
+	if state.PeerCertificates[0].KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Errorf("ECDSA certificate allows key encipherment")
+	}
+
+	// Clients which can only use RSA cipher suites get the RSA certificate.
+	legacy := client()
+	legacy.MaxVersion = tls.VersionTLS12
+	legacy.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	state = testHandshake(t, config, legacy)
+	if _, ok := state.PeerCertificates[0].PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("got %T key, want RSA for a client without ECDSA cipher suites", state.PeerCertificates[0].PublicKey)
+	}
+
+	c.LeafKeyType = LeafKeyECDSA
+	c.MaxVersion = tls.VersionTLS12
+	c.FlushCert("a.winston.conf")
+	config, err = c.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.GetCertificate != nil {
+		t.Errorf("got %d certificates, want only ECDSA", len(config.Certificates))
+	}
+	state = testHandshake(t, config, client())
+	if _, ok := state.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey); !ok || state.Version != tls.VersionTLS12 {
+		t.Errorf("got %T key with version %#x, want ECDSA with TLS 1.2", state.PeerCertificates[0].PublicKey, state.Version)
+	}
+}
+
+func TestSignerCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDiskCertStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestConfigServer(t)
+	c.Store = store
+	config, err := c.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := config.Certificates[0].Leaf.SerialNumber
+
+	// A restarted server with the same CA serves the stored certificate.
+	restarted := &GoproxyConfigServer{
+		Root:     c.Root,
+		RootCAs:  c.RootCAs,
+		capriv:   c.capriv,
+		priv:     c.priv,
+		keyID:    c.keyID,
+		validity: c.validity,
+		Store:    store,
+	}
+	config, err = restarted.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Certificates[0].Leaf.SerialNumber; got.Cmp(serial) != 0 {
+		t.Errorf("got serial %v after restart, want stored serial %v", got, serial)
+	}
+	testHandshake(t, config, &tls.Config{RootCAs: c.RootCAs, ServerName: "a.winston.conf"})
+
+	// Certificates signed by another CA are discarded.
+	other := newTestConfigServer(t)
+	other.Store = store
+	config, err = other.cert("a.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Certificates[0].Leaf.CheckSignatureFrom(other.Root); err != nil {
+		t.Errorf("certificate from another CA was served: %v", err)
+	}
+
+	other.FlushCert("a.winston.conf")
+	if stored, err := store.Load("a.winston.conf"); err != nil || stored != nil {
+		t.Errorf("got %v, %v after flushing, want no stored certificate", stored, err)
+	}
+
+	// Failed probes are stored, and aren't retried after a restart until the negative cache
+	// entry expires.
+	prober := &fakeProber{err: errors.New("unreachable")}
+	c.Prober = prober
+	c.NegativeCache.ProbeError = time.Hour
+	if _, err := c.Cert("down.example.com"); err != prober.err {
+		t.Fatalf("got error %v, want %v", err, prober.err)
+	}
+	restart := func() *GoproxyConfigServer {
+		return &GoproxyConfigServer{
+			Root:          c.Root,
+			RootCAs:       c.RootCAs,
+			capriv:        c.capriv,
+			priv:          c.priv,
+			keyID:         c.keyID,
+			validity:      c.validity,
+			Store:         store,
+			Prober:        prober,
+			NegativeCache: c.NegativeCache,
+		}
+	}
+	if _, err := restart().Cert("down.example.com"); err == nil || err.Error() != prober.err.Error() {
+		t.Errorf("got error %v after restart, want %v", err, prober.err)
+	}
+	if prober.probes != 1 {
+		t.Errorf("got %d probes, want 1", prober.probes)
+	}
+
+	// Once it expires, the origin is probed again.
+	stored, err := store.Load("down.example.com")
+	if err != nil || stored == nil {
+		t.Fatalf("got %v, %v, want a stored probe error", stored, err)
+	}
+	stored.NextAttempt = time.Now().Add(-time.Second)
+	if err := store.Save("down.example.com", stored); err != nil {
+		t.Fatal(err)
+	}
+	restart().Cert("down.example.com")
+	if prober.probes != 2 {
+		t.Errorf("got %d probes after the entry expired, want 2", prober.probes)
+	}
+}
+
+func TestSignerConcurrentCerts(t *testing.T) {
+	c := newTestConfigServer(t)
+	c.bypassDnsDialer = &net.Dialer{Timeout: time.Second}
+	if certtransport == nil {
+		certtransport = intransport.NewInTransport(nil)
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+
+	// Starts an origin which holds each connection for long enough that all of the calls start
+	// while the first probe is in progress, then passes it to serve. Returns its address and the
+	// number of connections made to it.
+	origin := func(serve func(net.Conn)) (string, *int32) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var probes int32
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&probes, 1)
+				go func() {
+					defer conn.Close()
+					time.Sleep(500 * time.Millisecond)
+					serve(conn)
+				}()
+			}
+		}()
+		listeners = append(listeners, ln)
+		return ln.Addr().String(), &probes
+	}
+
+	// Returns the configs and errors of 100 concurrent Cert() calls for host.
+	certs := func(host string) ([]*tls.Config, []error) {
+		configs := make([]*tls.Config, 100)
+		errs := make([]error, 100)
+		var wg sync.WaitGroup
+		for i := range configs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				configs[i], errs[i] = c.Cert(host)
+			}(i)
+		}
+		wg.Wait()
+		return configs, errs
+	}
+
+	// The origin is probed once, and every caller gets the one certificate signed.
+	originConfig, err := c.Cert("origin.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, probes := origin(func(conn net.Conn) {
+		tls.Server(conn, originConfig).Handshake()
+	})
+	configs, errs := certs(addr)
+	for i := range configs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if configs[i] != configs[0] {
+			t.Fatalf("call %d got a different config, so the certificate was signed more than once", i)
+		}
+	}
+	if n := atomic.LoadInt32(probes); n != 1 {
+		t.Errorf("origin was probed %d times, want 1", n)
+	}
+
+	// The callers share the error of a failed probe.
+	c.FlushCert(addr)
+	addr, probes = origin(func(conn net.Conn) {})
+	_, errs = certs(addr)
+	for i, err := range errs {
+		if err == nil {
+			t.Fatalf("call %d succeeded without a TLS origin", i)
+		}
+	}
+	if n := atomic.LoadInt32(probes); n != 1 {
+		t.Errorf("origin was probed %d times after an error, want 1", n)
+	}
+}
+
+func TestSignerCacheHitSkipsFlight(t *testing.T) {
+	c := newTestConfigServer(t)
+	cached, err := c.Cert("cached.winston.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold a call for the host open. Lookups which hit the cache mustn't wait for it.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go c.flights.do("cached.winston.conf", func() (*tls.Config, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	defer close(release)
+	<-started
+
+	done := make(chan *tls.Config, 1)
+	go func() {
+		config, _ := c.Cert("cached.winston.conf")
+		done <- config
+	}()
+	select {
+	case config := <-done:
+		if config != cached {
+			t.Error("got a different config for a cached host")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cache hit waited for the call in progress")
+	}
+}
+
+// A CertProber which returns a fixed chain or error.
+type fakeProber struct {
+	chain     []*x509.Certificate
+	err       error
+	verifyErr error
+	probes    int32
+}
+
+func (p *fakeProber) ProbeCert(host, port string) ([]*x509.Certificate, error) {
+	atomic.AddInt32(&p.probes, 1)
+	return p.chain, p.err
+}
+
+func (p *fakeProber) VerifyCert(chain []*x509.Certificate) error {
+	return p.verifyErr
+}
+
+func TestSignerCertProber(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com", Organization: []string{"Example"}},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour).Truncate(time.Second),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestConfigServer(t)
+	prober := &fakeProber{chain: []*x509.Certificate{origin}}
+	c.Prober = prober
+
+	// The origin's certificate is copied.
+	config, err := c.Cert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := config.Certificates[0].Leaf
+	if prober.probes != 1 || leaf.Subject.CommonName != "example.com" || len(leaf.DNSNames) != 2 || !leaf.NotAfter.Equal(origin.NotAfter) {
+		t.Errorf("got %d probes and a certificate for %s %v until %v, want a copy of the origin's", prober.probes, leaf.Subject.CommonName, leaf.DNSNames, leaf.NotAfter)
+	}
+	if err := leaf.CheckSignatureFrom(c.Root); err != nil {
+		t.Errorf("copied certificate isn't signed by the root: %v", err)
+	}
+
+	// Untrusted certificates are copied with an expired validity and aren't probed again until
+	// the negative cache entry expires.
+	c.NegativeCache.Untrusted = time.Minute
+	prober.verifyErr = errors.New("untrusted")
+	config, err = c.Cert("untrusted.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := config.Certificates[0].Leaf; leaf.NotAfter.After(time.Now()) {
+		t.Errorf("untrusted certificate copied as valid until %v", leaf.NotAfter)
+	}
+	info, _ := c.hosts.get(c.CacheLimits, "untrusted.example.com")
+	if retry := time.Until(info.NextAttempt); retry < 50*time.Second || retry > time.Minute {
+		t.Errorf("got next attempt in %v, want 1m", retry)
+	}
+
+	// Failed probes are retried every time by default...
+	prober.err = errors.New("unreachable")
+	prober.probes = 0
+	for i := 0; i < 2; i++ {
+		if _, err := c.Cert("down.example.com"); err != prober.err {
+			t.Errorf("got error %v, want %v", err, prober.err)
+		}
+	}
+	if prober.probes != 2 {
+		t.Errorf("got %d probes, want 2", prober.probes)
+	}
+
+	// ...or not until the negative cache entry expires.
+	c.NegativeCache.ProbeError = time.Hour
+	prober.probes = 0
+	for i := 0; i < 2; i++ {
+		if _, err := c.Cert("down.example.com"); err != prober.err {
+			t.Errorf("got error %v, want %v", err, prober.err)
+		}
+	}
+	if prober.probes != 1 {
+		t.Errorf("got %d probes, want 1", prober.probes)
+	}
+}
+
+func TestDialCertProberTimeout(t *testing.T) {
+	// The origin accepts connections but never completes a handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	prober := &DialCertProber{Timeout: 100 * time.Millisecond, TimeoutRetries: 1}
+	start := time.Now()
+	if _, err := prober.ProbeCert(host, port); err == nil {
+		t.Fatal("probe succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Errorf("got %d attempts, want 2", n)
+	}
+}
+
+func TestSignerMirrorProfile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sct := pkix.Extension{Id: oidExtensionSCTList, Value: []byte{0x04, 0x02, 0x00, 0x00}}
+	policies, err := asn1.Marshal([]struct{ Policy asn1.ObjectIdentifier }{{asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:        big.NewInt(1),
+		Subject:             pkix.Name{CommonName: "example.com"},
+		DNSNames:            []string{"example.com"},
+		NotBefore:           time.Now().Add(-time.Hour),
+		NotAfter:            time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:            x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:         []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		SubjectKeyId:        []byte{1, 2, 3, 4},
+		PermittedDNSDomains: []string{"example.com"},
+		ExtraExtensions:     []pkix.Extension{sct, {Id: oidExtensionCertificatePolicies, Value: policies}},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestConfigServer(t)
+	c.Prober = &fakeProber{chain: []*x509.Certificate{origin}}
+	leaf := func(host string) *x509.Certificate {
+		c.FlushCert(host)
+		config, err := c.Cert(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.Certificates[0].Leaf
+	}
+	hasSCT := func(cert *x509.Certificate) bool {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionSCTList) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// By default, only the attributes which were always copied are.
+	cert := leaf("example.com")
+	if len(cert.ExtKeyUsage) != 1 || !bytes.Equal(cert.SubjectKeyId, c.keyID) || hasSCT(cert) || len(cert.PolicyIdentifiers) != 0 || len(cert.PermittedDNSDomains) != 0 {
+		t.Errorf("default profile copied more than it should: %v %x %v %v", cert.ExtKeyUsage, cert.SubjectKeyId, cert.PolicyIdentifiers, cert.PermittedDNSDomains)
+	}
+	if cert.Subject.CommonName != "example.com" || !cert.NotAfter.Equal(origin.NotAfter.Truncate(time.Second)) {
+		t.Errorf("default profile didn't copy the subject and validity")
+	}
+
+	c.Mirror = &FullMirrorProfile
+	cert = leaf("example.com")
+	if len(cert.ExtKeyUsage) != 2 || !hasSCT(cert) || len(cert.PolicyIdentifiers) != 1 {
+		t.Errorf("full profile didn't copy every attribute: %v %v", cert.ExtKeyUsage, cert.PolicyIdentifiers)
+	}
+
+	// Leaves never carry name constraints, and the subject key ID is only copied on request.
+	if !bytes.Equal(cert.SubjectKeyId, c.keyID) || len(cert.PermittedDNSDomains) != 0 {
+		t.Errorf("full profile copied the key ID %x and name constraints %v", cert.SubjectKeyId, cert.PermittedDNSDomains)
+	}
+	c.Mirror = &MirrorProfile{SubjectKeyId: true}
+	if cert = leaf("example.com"); !bytes.Equal(cert.SubjectKeyId, origin.SubjectKeyId) {
+		t.Errorf("got key ID %x, want the origin's %x", cert.SubjectKeyId, origin.SubjectKeyId)
+	}
+
+	// Without a copied validity, the signer's own is used.
+	c.Mirror = &MirrorProfile{DNSNames: true}
+	cert = leaf("example.com")
+	if cert.NotAfter.Equal(origin.NotAfter.Truncate(time.Second)) || cert.Subject.CommonName != "example.com" || len(cert.Subject.Organization) != 1 {
+		t.Errorf("got subject %v until %v, want the signer's", cert.Subject, cert.NotAfter)
+	}
+
+	// Wildcard names cover sibling hosts.
+	c.Mirror = &MirrorProfile{WildcardSANs: true}
+	cert = leaf("www.example.com")
+	for _, host := range []string{"www.example.com", "mail.example.com"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("wildcard certificate doesn't cover %s: %v", host, err)
+		}
+	}
+	if err := cert.VerifyHostname("example.com"); err == nil {
+		t.Errorf("wildcard certificate covers its parent domain")
+	}
+}
+
+func TestWildcardSAN(t *testing.T) {
+	tests := []struct {
+		host, wildcard string
+	}{
+		{"www.example.com", "*.example.com"},
+		{"a.b.example.com", "*.b.example.com"},
+		{"www.example.co.uk", "*.example.co.uk"},
+		{"example.com", ""},
+		{"example.co.uk", ""},
+		{"localhost", ""},
+		{"10.0.0.1", ""},
+		{"::1", ""},
+	}
+	for _, test := range tests {
+		wildcard, ok := wildcardSAN(test.host)
+		if wildcard != test.wildcard || ok != (test.wildcard != "") {
+			t.Errorf("wildcardSAN(%q) = %q, %v; want %q", test.host, wildcard, ok, test.wildcard)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package goproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelInfo describes a client connection which ForwardConnect() or ForwardRequest() has fused
+// to an upstream connection.
+type TunnelInfo struct {
+	Session         int64  // ProxyCtx.Session of the request which opened the tunnel
+	Host            string // Destination host:port
+	SNI             string // Server name sent by TLS clients
+	Client          string // Client address
+	CipherSignature string
+
+	Start        time.Time
+	LastActivity time.Time // Last time data was read from either side
+	End          time.Time // Zero while the tunnel is open
+
+	BytesUp   uint64 // Bytes read from the client
+	BytesDown uint64 // Bytes read from the destination
+}
+
+// Age returns how long the tunnel has been open, or was open for if it has closed.
+func (t TunnelInfo) Age() time.Duration {
+	if t.End.IsZero() {
+		return time.Since(t.Start)
+	}
+	return t.End.Sub(t.Start)
+}
+
+type tunnel struct {
+	// Updated atomically, so must be first for 32-bit platforms.
+	up, down     uint64
+	lastActivity int64 // UnixNano
+
+	session         int64
+	host            string
+	sni             string
+	client          string
+	cipherSignature string
+	start           time.Time
+	clientConn      net.Conn
+	targetConn      net.Conn
+}
+
+func (t *tunnel) info() TunnelInfo {
+	return TunnelInfo{
+		Session:         t.session,
+		Host:            t.host,
+		SNI:             t.sni,
+		Client:          t.client,
+		CipherSignature: t.cipherSignature,
+		Start:           t.start,
+		LastActivity:    time.Unix(0, atomic.LoadInt64(&t.lastActivity)),
+		BytesUp:         atomic.LoadUint64(&t.up),
+		BytesDown:       atomic.LoadUint64(&t.down),
+	}
+}
+
+func (t *tunnel) close() {
+	t.clientConn.Close()
+	t.targetConn.Close()
+}
+
+// The tunnels which are currently open, by session. The zero value is ready to use.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[int64]*tunnel
+}
+
+// Registers a tunnel between the client and targetSiteConn. The returned connections count the
+// bytes passing through them and should be fused in place of the originals.
+func (r *tunnelRegistry) open(ctx *ProxyCtx, targetSiteConn net.Conn) (*tunnel, net.Conn, net.Conn) {
+	now := time.Now()
+	t := &tunnel{
+		lastActivity:    now.UnixNano(),
+		session:         ctx.Session,
+		host:            ctx.host,
+		cipherSignature: ctx.CipherSignature,
+		start:           now,
+		clientConn:      ctx.Conn,
+		targetConn:      targetSiteConn,
+	}
+	if ctx.sniffedTLS {
+		t.sni = ctx.serverName
+	}
+	if ctx.ClientAddr != nil {
+		t.client = ctx.ClientAddr.String()
+	} else if ctx.Conn != nil {
+		t.client = ctx.Conn.RemoteAddr().String()
+	}
+
+	r.mu.Lock()
+	if r.tunnels == nil {
+		r.tunnels = make(map[int64]*tunnel)
+	}
+	r.tunnels[t.session] = t
+	r.mu.Unlock()
+
+	return t, &countingConn{Conn: ctx.Conn, n: &t.up, last: &t.lastActivity}, &countingConn{Conn: targetSiteConn, n: &t.down, last: &t.lastActivity}
+}
+
+// Unregisters a tunnel and returns its final totals.
+func (r *tunnelRegistry) close(t *tunnel) TunnelInfo {
+	r.mu.Lock()
+	if r.tunnels[t.session] == t {
+		delete(r.tunnels, t.session)
+	}
+	r.mu.Unlock()
+
+	info := t.info()
+	info.End = time.Now()
+	return info
+}
+
+func (r *tunnelRegistry) list() []TunnelInfo {
+	r.mu.Lock()
+	tunnels := make([]TunnelInfo, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t.info())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Session < tunnels[j].Session })
+	return tunnels
+}
+
+func (r *tunnelRegistry) kill(session int64) bool {
+	r.mu.Lock()
+	t, ok := r.tunnels[session]
+	r.mu.Unlock()
+
+	if ok {
+		t.close()
+	}
+	return ok
+}
+
+// Tunnels returns the tunnels which are currently open, oldest first.
+func (proxy *ProxyHttpServer) Tunnels() []TunnelInfo {
+	return proxy.tunnels.list()
+}
+
+// KillTunnel closes both sides of the tunnel opened by a session. Returns false if the session
+// has no open tunnel.
+func (proxy *ProxyHttpServer) KillTunnel(session int64) bool {
+	return proxy.tunnels.kill(session)
+}
+
+// Fuses the client connection to targetSiteConn and copies data between them until either side
+// closes, then closes both. sent is the number of bytes already forwarded on the client's behalf,
+// such as a replayed request.
+func (ctx *ProxyCtx) fuse(targetSiteConn net.Conn, sent int) {
+	// Let Shutdown() close the upstream side of the tunnel if it has to give up waiting.
+	ctx.Proxy.trackConn(targetSiteConn, true)
+	defer ctx.Proxy.trackConn(targetSiteConn, false)
+
+	t, clientConn, targetConn := ctx.Proxy.tunnels.open(ctx, targetSiteConn)
+	atomic.AddUint64(&t.up, uint64(sent))
+
+	fitter.Fit(ctx.rateLimited(clientConn, true), ctx.rateLimited(targetConn, false))
+	ctx.Conn.Close()
+	targetSiteConn.Close()
+
+	info := ctx.Proxy.tunnels.close(t)
+	if ctx.Proxy.OnTunnelClosed != nil {
+		ctx.Proxy.OnTunnelClosed(ctx, info)
+	}
+}
+
+// A net.Conn which counts the bytes read from it.
+type countingConn struct {
+	net.Conn
+	n    *uint64
+	last *int64 // Time of the last read, in UnixNano
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(c.n, uint64(n))
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}